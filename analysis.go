@@ -0,0 +1,218 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+)
+
+// tokenFor returns the token byte for a keyword.
+func tokenFor(keyword string) byte {
+	for i, k := range keywords {
+		if k == keyword {
+			return byte(128 + i)
+		}
+	}
+	panic("no keyword " + keyword)
+}
+
+// Tokens from TAB( on are not statements, and from SGN on are functions.
+var firstNonStatement = tokenFor("TAB(")
+var firstFunction = tokenFor("SGN")
+
+// Statements that can also follow something else in a statement: ON x GOTO,
+// IF x GOTO and CSAVE "name",AUTO.
+var midStatementTokens = map[byte]bool{tokenFor("GOTO"): true, tokenFor("GOSUB"): true, tokenFor("AUTO"): true}
+
+// Functions that take no argument.
+var bareFunctions = map[byte]bool{tokenFor("PI"): true, tokenFor("TRUE"): true, tokenFor("FALSE"): true,
+	tokenFor("KEY$"): true, tokenFor("&"): true}
+
+// Operators that need something after them.
+var operatorTokens = map[byte]bool{tokenFor("NOT"): true, tokenFor("+"): true, tokenFor("-"): true,
+	tokenFor("*"): true, tokenFor("/"): true, tokenFor("^"): true, tokenFor("AND"): true, tokenFor("OR"): true,
+	tokenFor(">"): true, tokenFor("="): true, tokenFor("<"): true}
+
+// checkBasic looks over the lines of a program for signs of corruption that
+// still read as plausible text: line numbers out of order, jumps to lines
+// that don't exist, unbalanced quotes and brackets, tokens where they can't
+// be and control characters outside strings. What it finds is kept with
+// each line.
+func checkBasic(prog *program) {
+	numbers := map[int]bool{}
+	for _, l := range prog.lines {
+		numbers[lineNumber(*prog, l)] = true
+	}
+	for li := range prog.lines {
+		l := &prog.lines[li]
+		l.suspect = nil
+		n := lineNumber(*prog, *l)
+		if li > 0 {
+			if prev := lineNumber(*prog, prog.lines[li-1]); n <= prev {
+				l.suspect = append(l.suspect, fmt.Sprintf("line %d is not after line %d", n, prev))
+			}
+		}
+		if n > 63999 {
+			l.suspect = append(l.suspect, fmt.Sprintf("line number %d is too big", n))
+		}
+		l.suspect = append(l.suspect, checkLine(*prog, *l, numbers)...)
+	}
+}
+
+// lineNumber returns the number of a line, from the bytes after its link.
+func lineNumber(prog program, l lineInfo) int {
+	if l.firstByte+3 >= len(prog.bytes) {
+		return -1
+	}
+	return int(prog.bytes[l.firstByte+2].v) + 256*int(prog.bytes[l.firstByte+3].v)
+}
+
+// checkLine checks the statements of one line.
+func checkLine(prog program, l lineInfo, numbers map[int]bool) (found []string) {
+	var text []byte
+	damaged := false
+	for i := l.firstByte + 4; i <= l.lastByte && i < len(prog.bytes) && prog.bytes[i].v != 0; i++ {
+		text = append(text, prog.bytes[i].v)
+		damaged = damaged || prog.bytes[i].missing
+	}
+	seen := map[string]bool{}
+	report := func(format string, a ...interface{}) {
+		if s := fmt.Sprintf(format, a...); !seen[s] {
+			seen[s] = true
+			found = append(found, s)
+		}
+	}
+
+	// next returns the index of the next byte that isn't a space.
+	next := func(i int) int {
+		for i < len(text) && text[i] == ' ' {
+			i++
+		}
+		return i
+	}
+	// targets checks the line numbers after a jump, returning where they
+	// end and whether there were any.
+	targets := func(kw string, i int) (int, bool) {
+		ok := false
+		for {
+			j := next(i)
+			if j == len(text) || text[j] < '0' || text[j] > '9' {
+				return i, ok
+			}
+			n := 0
+			for ; j < len(text) && text[j] >= '0' && text[j] <= '9'; j++ {
+				n = n*10 + int(text[j]-'0')
+			}
+			if !numbers[n] {
+				report("%s %d goes to a line that isn't there", kw, n)
+			}
+			ok = true
+			if i = next(j); i == len(text) || text[i] != ',' {
+				return i, ok
+			}
+			i++
+		}
+	}
+
+	inString, inData := false, false
+	stringStart := 0
+	depth := 0
+	statementStart := true
+	endStatement := func() {
+		if depth != 0 && !damaged {
+			report("unbalanced brackets")
+		}
+		depth = 0
+		statementStart, inData = true, false
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if inString {
+			inString = c != '"'
+			continue
+		}
+		switch {
+		case c == '"':
+			inString, stringStart = true, i
+		case c == ':':
+			endStatement()
+			continue
+		case c == ' ':
+			continue
+		case c < 32:
+			report("control character %d outside a string", c)
+		case inData:
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth--; depth < 0 && !damaged {
+				report("unbalanced brackets")
+				depth = 0
+			}
+		case c >= 128 && int(c-128) >= len(keywords):
+			report("unknown token $%02x", c)
+		case c >= 128:
+			kw := keywords[c-128]
+			after := next(i + 1)
+			end := after == len(text) || text[after] == ':'
+			switch {
+			case c < firstNonStatement && !statementStart && !midStatementTokens[c]:
+				report("%s in the middle of a statement", kw)
+			case c >= firstFunction && !bareFunctions[c] && (after == len(text) || text[after] != '('):
+				report("%s with no argument", kw)
+			case operatorTokens[c] && (end || text[after] == ')'):
+				report("%s with nothing after it", kw)
+			}
+			switch kw {
+			case "REM":
+				return
+			case "DATA":
+				inData = true
+			case "TAB(", "SPC(":
+				depth++
+			case "FN":
+				if end || text[after] < 'A' || text[after] > 'Z' {
+					report("FN with no function name")
+				}
+			case "GOTO", "GOSUB":
+				var ok bool
+				if i, ok = targets(kw, i+1); !ok {
+					report("%s with no line number", kw)
+				}
+				i--
+				statementStart = false
+				continue
+			case "THEN", "ELSE":
+				i, _ = targets(kw, i+1)
+				i--
+				statementStart = true
+				continue
+			}
+		}
+		statementStart = false
+	}
+	if inString && !damaged {
+		// A line may end inside a string, but keywords are only tokenised
+		// outside strings, so a statement after a : means a quote was lost.
+		for i := stringStart; i < len(text); i++ {
+			if j := next(i + 1); text[i] == ':' && j < len(text) && text[j] >= 128 && int(text[j]-128) < len(keywords) {
+				report("string not closed before :%s", keywords[text[j]-128])
+				break
+			}
+		}
+	}
+	endStatement()
+	return
+}
@@ -0,0 +1,220 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const oricEsc = 27
+
+// Control codes are shown as the Unicode control pictures, which start here.
+const controlPictures = 0x2400
+
+var oricColourNames = [8]string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// oricFont is a character set for codes 32 to 127 drawn to look like the
+// Oric's standard one: eight rows of six pixels to a character, the leftmost
+// in bit 5, with the bottom row left blank.
+var oricFont = [96 * 8]byte{
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // space
+	0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x04, 0x00, // !
+	0x0a, 0x0a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // "
+	0x0a, 0x0a, 0x1f, 0x0a, 0x1f, 0x0a, 0x0a, 0x00, // #
+	0x04, 0x0f, 0x14, 0x0e, 0x05, 0x1e, 0x04, 0x00, // $
+	0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03, 0x00, // %
+	0x0c, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0d, 0x00, // &
+	0x04, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, // '
+	0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02, 0x00, // (
+	0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08, 0x00, // )
+	0x00, 0x04, 0x15, 0x0e, 0x15, 0x04, 0x00, 0x00, // *
+	0x00, 0x04, 0x04, 0x1f, 0x04, 0x04, 0x00, 0x00, // +
+	0x00, 0x00, 0x00, 0x00, 0x04, 0x04, 0x08, 0x00, // ,
+	0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00, 0x00, // -
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0x00, // .
+	0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00, 0x00, // /
+	0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e, 0x00, // 0
+	0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e, 0x00, // 1
+	0x0e, 0x11, 0x01, 0x06, 0x08, 0x10, 0x1f, 0x00, // 2
+	0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e, 0x00, // 3
+	0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02, 0x00, // 4
+	0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e, 0x00, // 5
+	0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e, 0x00, // 6
+	0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08, 0x00, // 7
+	0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e, 0x00, // 8
+	0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c, 0x00, // 9
+	0x00, 0x00, 0x04, 0x00, 0x04, 0x00, 0x00, 0x00, // :
+	0x00, 0x00, 0x04, 0x00, 0x04, 0x04, 0x08, 0x00, // ;
+	0x02, 0x04, 0x08, 0x10, 0x08, 0x04, 0x02, 0x00, // <
+	0x00, 0x00, 0x1f, 0x00, 0x1f, 0x00, 0x00, 0x00, // =
+	0x08, 0x04, 0x02, 0x01, 0x02, 0x04, 0x08, 0x00, // >
+	0x0e, 0x11, 0x02, 0x04, 0x04, 0x00, 0x04, 0x00, // ?
+	0x0e, 0x11, 0x17, 0x15, 0x17, 0x10, 0x0f, 0x00, // @
+	0x04, 0x0a, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x00, // A
+	0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e, 0x00, // B
+	0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e, 0x00, // C
+	0x1e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x1e, 0x00, // D
+	0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f, 0x00, // E
+	0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10, 0x00, // F
+	0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f, 0x00, // G
+	0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11, 0x00, // H
+	0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e, 0x00, // I
+	0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c, 0x00, // J
+	0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11, 0x00, // K
+	0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f, 0x00, // L
+	0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11, 0x00, // M
+	0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11, 0x00, // N
+	0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e, 0x00, // O
+	0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10, 0x00, // P
+	0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d, 0x00, // Q
+	0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11, 0x00, // R
+	0x0e, 0x11, 0x10, 0x0e, 0x01, 0x11, 0x0e, 0x00, // S
+	0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04, 0x00, // T
+	0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e, 0x00, // U
+	0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04, 0x00, // V
+	0x11, 0x11, 0x11, 0x15, 0x15, 0x1b, 0x11, 0x00, // W
+	0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11, 0x00, // X
+	0x11, 0x11, 0x0a, 0x04, 0x04, 0x04, 0x04, 0x00, // Y
+	0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f, 0x00, // Z
+	0x0e, 0x08, 0x08, 0x08, 0x08, 0x08, 0x0e, 0x00, // [
+	0x00, 0x10, 0x08, 0x04, 0x02, 0x01, 0x00, 0x00, // \
+	0x0e, 0x02, 0x02, 0x02, 0x02, 0x02, 0x0e, 0x00, // ]
+	0x04, 0x0a, 0x11, 0x00, 0x00, 0x00, 0x00, 0x00, // ^
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f, 0x00, // _
+	0x0e, 0x11, 0x16, 0x14, 0x16, 0x11, 0x0e, 0x00, // ©
+	0x00, 0x00, 0x0e, 0x01, 0x0f, 0x11, 0x0f, 0x00, // a
+	0x10, 0x10, 0x16, 0x19, 0x11, 0x11, 0x1e, 0x00, // b
+	0x00, 0x00, 0x0e, 0x10, 0x10, 0x11, 0x0e, 0x00, // c
+	0x01, 0x01, 0x0d, 0x13, 0x11, 0x11, 0x0f, 0x00, // d
+	0x00, 0x00, 0x0e, 0x11, 0x1f, 0x10, 0x0e, 0x00, // e
+	0x06, 0x09, 0x08, 0x1c, 0x08, 0x08, 0x08, 0x00, // f
+	0x00, 0x0f, 0x11, 0x11, 0x0f, 0x01, 0x0e, 0x00, // g
+	0x10, 0x10, 0x16, 0x19, 0x11, 0x11, 0x11, 0x00, // h
+	0x04, 0x00, 0x0c, 0x04, 0x04, 0x04, 0x0e, 0x00, // i
+	0x02, 0x00, 0x06, 0x02, 0x02, 0x12, 0x0c, 0x00, // j
+	0x10, 0x10, 0x12, 0x14, 0x18, 0x14, 0x12, 0x00, // k
+	0x0c, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e, 0x00, // l
+	0x00, 0x00, 0x1a, 0x15, 0x15, 0x11, 0x11, 0x00, // m
+	0x00, 0x00, 0x16, 0x19, 0x11, 0x11, 0x11, 0x00, // n
+	0x00, 0x00, 0x0e, 0x11, 0x11, 0x11, 0x0e, 0x00, // o
+	0x00, 0x00, 0x1e, 0x11, 0x1e, 0x10, 0x10, 0x00, // p
+	0x00, 0x00, 0x0d, 0x13, 0x0f, 0x01, 0x01, 0x00, // q
+	0x00, 0x00, 0x16, 0x19, 0x10, 0x10, 0x10, 0x00, // r
+	0x00, 0x00, 0x0e, 0x10, 0x0e, 0x01, 0x1e, 0x00, // s
+	0x08, 0x08, 0x1c, 0x08, 0x08, 0x09, 0x06, 0x00, // t
+	0x00, 0x00, 0x11, 0x11, 0x11, 0x13, 0x0d, 0x00, // u
+	0x00, 0x00, 0x11, 0x11, 0x11, 0x0a, 0x04, 0x00, // v
+	0x00, 0x00, 0x11, 0x11, 0x15, 0x15, 0x0a, 0x00, // w
+	0x00, 0x00, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x00, // x
+	0x00, 0x00, 0x11, 0x11, 0x0f, 0x01, 0x0e, 0x00, // y
+	0x00, 0x00, 0x1f, 0x02, 0x04, 0x08, 0x1f, 0x00, // z
+	0x02, 0x04, 0x04, 0x08, 0x04, 0x04, 0x02, 0x00, // {
+	0x04, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04, 0x00, // |
+	0x08, 0x04, 0x04, 0x02, 0x04, 0x04, 0x08, 0x00, // }
+	0x00, 0x00, 0x08, 0x15, 0x02, 0x00, 0x00, 0x00, // ~
+	0x3f, 0x3f, 0x3f, 0x3f, 0x3f, 0x3f, 0x3f, 0x3f, // block
+
+}
+
+// mosaicFont returns an alternate character set for codes 32 to 127 made of
+// the block mosaics the Oric uses it for: the six bits of each code, from
+// bit 0, light the top left, top right, middle left and so on of a two by
+// three grid.
+func mosaicFont() []byte {
+	font := make([]byte, 96*8)
+	for c := 0; c < 96; c++ {
+		for y := 0; y < 8; y++ {
+			part := []int{0, 0, 0, 1, 1, 2, 2, 2}[y]
+			if c>>(2*part)&1 != 0 {
+				font[c*8+y] |= 0x38
+			}
+			if c>>(2*part+1)&1 != 0 {
+				font[c*8+y] |= 0x07
+			}
+		}
+	}
+	return font
+}
+
+// oricRune returns the character an Oric shows for a byte. The Oric set is
+// ASCII but for © in place of ` and a solid block for DEL. Control codes are
+// shown as their control pictures, so they are visible and don't reach the
+// terminal, and bytes from 128 up are left as they are.
+func oricRune(b byte) rune {
+	switch {
+	case b < 32:
+		return rune(controlPictures + int(b))
+	case b == 0x60:
+		return '©'
+	case b == 0x7f:
+		return '█'
+	}
+	return rune(b)
+}
+
+// isControlPicture says whether a character is one oricRune shows for a
+// control code.
+func isControlPicture(r rune) bool {
+	return r >= controlPictures && r < controlPictures+32
+}
+
+// attributeName describes a serial attribute, from 0 to 31: what it sets
+// for the rest of the row on screen.
+func attributeName(a byte) string {
+	switch {
+	case a < 8:
+		return oricColourNames[a] + " ink"
+	case a < 16:
+		name := []string{"standard", "alternate"}[a&1] + " characters"
+		if a&2 != 0 {
+			name = "double height " + name
+		}
+		if a&4 != 0 {
+			name = "flashing " + name
+		}
+		return name
+	case a < 24:
+		return oricColourNames[a-16] + " paper"
+	case a < 32:
+		name := []string{"60Hz", "50Hz"}[a>>1&1]
+		return name + []string{" text", " hires"}[a>>2&1]
+	}
+	return ""
+}
+
+// oricCodeText describes the byte at i if it is a control code, or part of
+// an ESC sequence that sets a serial attribute (ESC @ to ESC _).
+func oricCodeText(bytes []byteInfo, i int) string {
+	if i < 0 || i >= len(bytes) {
+		return ""
+	}
+	v := bytes[i].v
+	switch {
+	case v == oricEsc && i+1 < len(bytes) && bytes[i+1].v >= '@' && bytes[i+1].v <= '_':
+		return fmt.Sprintf("ESC %c: %s", bytes[i+1].v, attributeName(bytes[i+1].v-'@'))
+	case v >= '@' && v <= '_' && i > 0 && bytes[i-1].v == oricEsc:
+		return fmt.Sprintf("ESC %c: %s", v, attributeName(v-'@'))
+	case v < 32:
+		return fmt.Sprintf("control code %d (CTRL %c)", v, v+'@')
+	}
+	return ""
+}
+
+// textWidth returns how many cells a piece of decoded text takes up, leaving
+// out any colour escapes.
+func textWidth(s string) int {
+	return utf8.RuneCountInString(ansiEscapes.ReplaceAllString(s, ""))
+}
@@ -0,0 +1,422 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A demodulator reads the bits of a stream from its samples. Each bit is one
+// cycle, from one rising edge to the next.
+type demodulator interface {
+	demodulate(stream bitStream, settings decoderSettings) []bitInfo
+}
+
+var demodulatorNames = []string{"peak", "zero", "goertzel", "pll", "matched"}
+
+var demodulators = map[string]demodulator{
+	"":         peakDemodulator{},
+	"peak":     peakDemodulator{},
+	"zero":     zeroCrossingDemodulator{hysteresis: 0.2},
+	"goertzel": goertzelDemodulator{},
+	"pll":      pllDemodulator{hysteresis: 0.2, gain: 0.05},
+	"matched":  matchedDemodulator{minExamples: 16, minScore: 0.8, slack: 2},
+}
+
+// demodulatorFor returns the name of the demodulator to use on the stream
+// between the first and last samples. A stream's own choice is kept against
+// a sample in the middle of it, so it stays with the stream as others are
+// found or lost.
+func (s decoderSettings) demodulatorFor(first, last int) string {
+	name, at := s.Demodulator, -1
+	for sample, n := range s.StreamDemodulators {
+		if sample >= first && sample <= last && (at < 0 || sample < at) {
+			name, at = n, sample
+		}
+	}
+	if _, ok := demodulators[name]; !ok || name == "" {
+		return "peak"
+	}
+	return name
+}
+
+// peakDemodulator is readCycle: a search for the min and max in a 20 sample
+// window, crossing over half way between them.
+type peakDemodulator struct{}
+
+func (peakDemodulator) demodulate(stream bitStream, settings decoderSettings) []bitInfo {
+	s, _ := readBitStream(stream.samples[:stream.lastSample], stream.firstSample, settings)
+	return s.bits
+}
+
+type cycle struct {
+	start, fall, end int
+}
+
+// findCycles splits a stream into cycles where the signal falls below and
+// rises back above the middle of its range, ignoring any wiggle smaller than
+// the hysteresis (a fraction of the amplitude) either side of the middle.
+func findCycles(stream bitStream, hysteresis float64) (cycles []cycle) {
+	mid := (int(stream.minVal) + int(stream.maxVal)) / 2
+	h := int(float64(int(stream.maxVal)-int(stream.minVal)) / 2 * hysteresis)
+	high := true
+	start, fall := -1, -1
+	for i := stream.firstSample; i < min(stream.lastSample, len(stream.samples)); i++ {
+		v := int(stream.samples[i])
+		switch {
+		case high && v < mid-h:
+			high = false
+			fall = i
+		case !high && v > mid+h:
+			high = true
+			if start >= 0 {
+				cycles = append(cycles, cycle{start, fall, i})
+			}
+			start = i
+		}
+	}
+	return
+}
+
+// zeroCrossingDemodulator times each cycle between crossings of the middle of
+// the signal, with hysteresis so that noise near the middle doesn't split a
+// cycle in two.
+type zeroCrossingDemodulator struct {
+	hysteresis float64
+}
+
+func (d zeroCrossingDemodulator) demodulate(stream bitStream, settings decoderSettings) (bits []bitInfo) {
+	for _, c := range findCycles(stream, d.hysteresis) {
+		if bi, noSignal := decideBit(c.fall-c.start, c.end-c.fall, c.end-1, settings); !noSignal {
+			bits = append(bits, bi)
+		}
+	}
+	return
+}
+
+// nominalLengths returns the typical length of a 1 and of a 0 cycle, taken
+// from the clear bits the peak search found in the stream.
+func nominalLengths(stream bitStream, settings decoderSettings) (n1, n0 float64) {
+	var ones, zeros []int
+	for _, bi := range stream.bits {
+		switch {
+		case bi.unclear, bi.dropout:
+		case bi.v == 1:
+			ones = append(ones, bi.l1+bi.l2)
+		default:
+			zeros = append(zeros, bi.l1+bi.l2)
+		}
+	}
+	n1, n0 = float64(settings.ShortThreshold), float64(settings.LongThreshold)
+	if len(ones) > 0 {
+		sort.Ints(ones)
+		n1 = float64(ones[len(ones)/2])
+	}
+	if len(zeros) > 0 {
+		sort.Ints(zeros)
+		n0 = float64(zeros[len(zeros)/2])
+	}
+	return
+}
+
+// goertzelPower returns the power in a block of samples at the frequency
+// with the given period, normalised by the block length.
+func goertzelPower(samples []int16, period float64) float64 {
+	coeff := 2 * math.Cos(2*math.Pi/period)
+	var s1, s2 float64
+	for _, v := range samples {
+		s1, s2 = float64(v)+coeff*s1-s2, s1
+	}
+	n := float64(len(samples))
+	return (s1*s1 + s2*s2 - coeff*s1*s2) / (n * n)
+}
+
+// goertzelDemodulator decides each bit by which of the two tones has more
+// power in the cycle starting at the current edge, then moves on by that
+// tone's period, lining up with the nearest rising edge so it doesn't drift.
+type goertzelDemodulator struct{}
+
+func (goertzelDemodulator) demodulate(stream bitStream, settings decoderSettings) (bits []bitInfo) {
+	n1, n0 := nominalLengths(stream, settings)
+	cycles := findCycles(stream, 0.2)
+	if len(cycles) == 0 {
+		return
+	}
+	rises := make([]int, len(cycles))
+	for i, c := range cycles {
+		rises[i] = c.start
+	}
+	amplitude := float64(int(stream.maxVal)-int(stream.minVal)) / 2
+	quiet := amplitude * amplitude / 64
+
+	// nearest returns the edge in edges nearest to want, if it is within slack.
+	nearest := func(edges []int, want, slack int) (int, bool) {
+		i := sort.SearchInts(edges, want)
+		best, ok := 0, false
+		for _, j := range []int{i - 1, i} {
+			if j >= 0 && j < len(edges) && abs(edges[j]-want) <= slack && (!ok || abs(edges[j]-want) < abs(best-want)) {
+				best, ok = edges[j], true
+			}
+		}
+		return best, ok
+	}
+
+	pos := rises[0]
+	end := min(stream.lastSample, len(stream.samples))
+	for pos+int(n0) <= end {
+		p1 := goertzelPower(stream.samples[pos:pos+int(n1+0.5)], n1)
+		p0 := goertzelPower(stream.samples[pos:pos+int(n0+0.5)], n0)
+		if p1 < quiet && p0 < quiet {
+			// Nothing here: skip to the next edge.
+			i := sort.SearchInts(rises, pos+1)
+			if i == len(rises) {
+				break
+			}
+			pos = rises[i]
+			continue
+		}
+
+		bi := bitInfo{v: 1, firstSample: pos}
+		n := n1
+		if p0 > p1 {
+			bi.v, n = 0, n0
+		}
+		bi.unclear = math.Max(p0, p1) < 2*math.Min(p0, p1)
+		next := pos + int(n+0.5)
+		if r, ok := nearest(rises, next, int(n/4)); ok && r > pos {
+			next = r
+		}
+		bi.lastSample = next - 1
+
+		// Split the cycle where it falls through the middle.
+		bi.l1 = (next - pos) / 2
+		for _, c := range cycles[sort.Search(len(cycles), func(i int) bool { return cycles[i].end > pos }):] {
+			if c.fall > pos && c.fall < next {
+				bi.l1 = c.fall - pos
+			}
+			if c.start >= next {
+				break
+			}
+		}
+		bi.l2 = next - pos - bi.l1
+		bits = append(bits, bi)
+		pos = next
+	}
+	return
+}
+
+// pllDemodulator tracks the tape speed as it decodes. Each cycle is decided
+// by whether it is nearer the expected length of a 1 or a 0 at the current
+// speed, and the difference between the two nudges the speed, so that
+// stretched or squashed parts of the tape still decode. Cycles half way
+// between the two are unclear and don't steer the speed.
+type pllDemodulator struct {
+	hysteresis float64
+	gain       float64
+}
+
+func (d pllDemodulator) demodulate(stream bitStream, settings decoderSettings) (bits []bitInfo) {
+	n1, n0 := nominalLengths(stream, settings)
+	speed := 1.0
+	for _, c := range findCycles(stream, d.hysteresis) {
+		length := float64(c.end - c.start)
+		if length > float64(settings.NoSignalThreshold)*speed {
+			continue
+		}
+		e1, e0 := n1*speed, n0*speed
+		bi := bitInfo{v: 1, l1: c.fall - c.start, l2: c.end - c.fall, firstSample: c.start, lastSample: c.end - 1}
+		expected := e1
+		if math.Abs(length-e0) < math.Abs(length-e1) {
+			bi.v, expected = 0, e0
+		}
+		if math.Abs(length-(e1+e0)/2) < (e0-e1)/6 {
+			bi.unclear = true
+		} else {
+			speed = math.Max(0.8, math.Min(1.25, speed+d.gain*(length-expected)/expected))
+		}
+		bits = append(bits, bi)
+	}
+	return
+}
+
+// matchedDemodulator learns what a 1 and a 0 look like on this particular
+// tape from the bits of the bytes the peak search read cleanly and with the
+// right parity, then decides every other bit by which of the two shapes it
+// correlates with best. The correlation is the bit's confidence.
+type matchedDemodulator struct {
+	minExamples int
+	minScore    float64
+	slack       int
+}
+
+// normalise subtracts the mean from some samples and scales them to unit
+// length, returning nil if they are flat.
+func normalise(samples []float64) []float64 {
+	if len(samples) == 0 {
+		return nil
+	}
+	mean := 0.0
+	for _, v := range samples {
+		mean += v
+	}
+	mean = mean / float64(len(samples))
+	norm := 0.0
+	out := make([]float64, len(samples))
+	for i, v := range samples {
+		out[i] = v - mean
+		norm += out[i] * out[i]
+	}
+	if norm == 0 {
+		return nil
+	}
+	norm = math.Sqrt(norm)
+	for i := range out {
+		out[i] = out[i] / norm
+	}
+	return out
+}
+
+func normaliseSamples(samples []int16) []float64 {
+	f := make([]float64, len(samples))
+	for i, v := range samples {
+		f[i] = float64(v)
+	}
+	return normalise(f)
+}
+
+func (d matchedDemodulator) demodulate(stream bitStream, settings decoderSettings) []bitInfo {
+	bits := append([]bitInfo(nil), stream.bits...)
+	clean := make([]bool, len(bits))
+	for _, bti := range readProgramBytes(stream).bytes {
+		if !bti.chkErr && !bti.unclear {
+			for b := bti.firstBit; b <= bti.lastBit; b++ {
+				clean[b] = true
+			}
+		}
+	}
+
+	// Average the shape of the clean cycles of each value, over the typical
+	// length of a cycle of that value.
+	var examples [2][]bitInfo
+	for i, bi := range bits {
+		if clean[i] {
+			examples[bi.v] = append(examples[bi.v], bi)
+		}
+	}
+	if len(examples[0]) < d.minExamples || len(examples[1]) < d.minExamples {
+		return bits
+	}
+	n1, n0 := nominalLengths(bitStream{bits: append(examples[0], examples[1]...)}, settings)
+	lengths := [2]int{int(n0 + 0.5), int(n1 + 0.5)}
+	var templates [2][]float64
+	for v := range templates {
+		sum := make([]float64, lengths[v])
+		for _, bi := range examples[v] {
+			if bi.firstSample+lengths[v] <= len(stream.samples) {
+				for i, x := range normaliseSamples(stream.samples[bi.firstSample : bi.firstSample+lengths[v]]) {
+					sum[i] += x
+				}
+			}
+		}
+		if templates[v] = normalise(sum); templates[v] == nil {
+			return bits
+		}
+	}
+
+	// score returns the best correlation of a template with the samples
+	// starting near the given one.
+	score := func(v, first int) float64 {
+		best := -1.0
+		for off := -d.slack; off <= d.slack; off++ {
+			s := first + off
+			if s < 0 || s+lengths[v] > len(stream.samples) {
+				continue
+			}
+			c := 0.0
+			for i, x := range normaliseSamples(stream.samples[s : s+lengths[v]]) {
+				c += x * templates[v][i]
+			}
+			best = math.Max(best, c)
+		}
+		return best
+	}
+
+	for i := range bits {
+		bi := &bits[i]
+		s0, s1 := score(0, bi.firstSample), score(1, bi.firstSample)
+		if clean[i] {
+			bi.confidence = math.Max(0, []float64{s0, s1}[bi.v])
+			continue
+		}
+		bi.v = 1
+		if s0 > s1 {
+			bi.v = 0
+		}
+		bi.confidence = math.Max(0, math.Max(s0, s1))
+		bi.unclear = bi.confidence < d.minScore
+	}
+	return bits
+}
+
+// byteConfidence returns the lowest confidence of the bits in a byte, if the
+// demodulator measured it.
+func byteConfidence(p program, b int) (c float64, ok bool) {
+	c = 1
+	for _, bi := range p.stream.bits[p.bytes[b].firstBit : p.bytes[b].lastBit+1] {
+		if bi.confidence > 0 {
+			c, ok = math.Min(c, bi.confidence), true
+		}
+	}
+	return
+}
+
+// streamIndex returns which of the streams the given one is.
+func streamIndex(stream bitStream) int {
+	for i, s := range streams {
+		if s.firstSample == stream.firstSample {
+			return i
+		}
+	}
+	return 0
+}
+
+// nextDemodulator switches the current stream over to the next demodulator
+// and decodes the tape again.
+func nextDemodulator() {
+	if !needAudio("demodulate") {
+		return
+	}
+	si := streamIndex(prog.stream)
+	first, last := prog.stream.firstSample, prog.stream.lastSample
+	name := proj.Settings.demodulatorFor(first, last)
+	for i, n := range demodulatorNames {
+		if n == name {
+			name = demodulatorNames[(i+1)%len(demodulatorNames)]
+			break
+		}
+	}
+	// A sweep may still be reading the old choices.
+	choices := map[int]string{(first + last) / 2: name}
+	for sample, n := range proj.Settings.StreamDemodulators {
+		if sample < first || sample > last {
+			choices[sample] = n
+		}
+	}
+	proj.Settings.StreamDemodulators = choices
+	redecode()
+	setStatusMessage(fmt.Sprintf("Stream %d now uses the %s demodulator", si+1, name))
+}
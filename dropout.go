@@ -0,0 +1,111 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+// The value given to bytes lost in a dropout, so the Basic listing shows
+// where they were.
+const missingByte = '?'
+
+// isDropout says whether the gap between two runs of signal is short enough
+// to be a dropout within one stream rather than the gap between two.
+func isDropout(a, b bitStream, settings decoderSettings) bool {
+	gap := b.bits[0].firstSample - a.bits[len(a.bits)-1].lastSample - 1
+	return gap <= settings.MaxDropout*44100/1000
+}
+
+// programStart says whether a program has started in a run of signal, and
+// whether the run starts with the 0x16 sync bytes that lead into one.
+func programStart(run bitStream) (synced, leader bool) {
+	bytes := readProgramBytes(run).bytes
+	syncCount := 0
+	for i, bti := range bytes {
+		switch {
+		case bti.v == 0x16:
+			syncCount++
+		case bti.v == 0x24 && syncCount > 3:
+			synced = true
+		default:
+			syncCount = 0
+		}
+		if i == 3 {
+			leader = syncCount == 4
+		}
+		if synced {
+			break
+		}
+	}
+	return
+}
+
+// bridgeDropout joins a run of signal on to the stream before it, with a
+// dropout bit standing for the gap between them.
+func bridgeDropout(a, b bitStream, settings decoderSettings) bitStream {
+	gap := bitInfo{v: 1, dropout: true,
+		firstSample: a.bits[len(a.bits)-1].lastSample + 1, lastSample: b.bits[0].firstSample - 1}
+	gap.lastSample = max(gap.firstSample, gap.lastSample)
+	bits := make([]bitInfo, 0, len(a.bits)+1+len(b.bits))
+	bits = append(append(append(bits, a.bits...), gap), b.bits...)
+	a.bits = bits
+	a.lastSample = b.lastSample
+	a.minVal = min16(a.minVal, b.minVal)
+	a.maxVal = max16(a.maxVal, b.maxVal)
+	a.fragment = fragmentNone
+	if len(a.bits) < settings.minStreamBits() {
+		a.fragment = b.fragment
+	}
+	return a
+}
+
+// fillDropouts replaces the bytes framed across a dropout with as many
+// missing bytes as would have fitted in the gap, going by the average length
+// of the bytes before it.
+func fillDropouts(prog *program) {
+	bits := prog.stream.bits
+	var dropouts []int
+	for i, bi := range bits {
+		if bi.dropout {
+			dropouts = append(dropouts, i)
+		}
+	}
+	if len(dropouts) == 0 || len(prog.bytes) == 0 {
+		return
+	}
+
+	var bytes []byteInfo
+	d := 0
+	for _, bti := range prog.bytes {
+		// The start bit, data and parity can't have a dropout in them.
+		for d < len(dropouts) && dropouts[d] <= bti.lastBit-10 {
+			d++
+		}
+		if d < len(dropouts) && dropouts[d] <= bti.lastBit {
+			continue
+		}
+		if n := len(bytes); n > 0 && d > 0 && dropouts[d-1] > bytes[n-1].lastBit {
+			prev := bytes[n-1]
+			first := bits[bytes[0].firstBit].firstSample
+			perByte := float64(bits[prev.lastBit].lastSample-first+1) / float64(n)
+			// Bytes follow on from each other, so count how many fitted from
+			// the end of the last byte before the gap to the end of this one.
+			span := float64(bits[bti.lastBit].lastSample - bits[prev.lastBit].lastSample)
+			for i := 0; i < int(span/perByte+0.5)-1; i++ {
+				bytes = append(bytes, byteInfo{v: missingByte, firstBit: dropouts[d-1], lastBit: dropouts[d-1],
+					missing: true})
+			}
+		}
+		bytes = append(bytes, bti)
+	}
+	prog.bytes = bytes
+}
@@ -0,0 +1,386 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// The longest cycle that readCycle can measure is two search windows.
+const maxCycleLength = 76
+
+// A cycleHistogram counts how many cycles in a stream have each length, for
+// the high (l1) and low (l2) halves and the whole cycle.
+type cycleHistogram struct {
+	l1, l2, total []int
+}
+
+func newCycleHistogram(bits []bitInfo) (h cycleHistogram) {
+	h.l1 = make([]int, maxCycleLength+1)
+	h.l2 = make([]int, maxCycleLength+1)
+	h.total = make([]int, maxCycleLength+1)
+	for _, bi := range bits {
+		if bi.dropout {
+			continue
+		}
+		h.l1[max(0, min(maxCycleLength, bi.l1))]++
+		h.l2[max(0, min(maxCycleLength, bi.l2))]++
+		h.total[max(0, min(maxCycleLength, bi.l1+bi.l2))]++
+	}
+	return
+}
+
+// cycleClass says how a whole cycle of the given length is decided.
+type cycleClass int
+
+const (
+	cycleShort cycleClass = iota
+	cycleUnclear
+	cycleLong
+	cycleNoSignal
+)
+
+func classifyCycle(length int, settings decoderSettings) cycleClass {
+	switch {
+	case length > settings.NoSignalThreshold:
+		return cycleNoSignal
+	case length >= settings.LongThreshold:
+		return cycleLong
+	case length <= settings.ShortThreshold:
+		return cycleShort
+	}
+	return cycleUnclear
+}
+
+var cycleClassColors = []string{CLR_G, CLR_Y, CLR_B, CLR_R}
+
+// printHistograms prints the cycle length histograms of each stream, with
+// the thresholds marked. Half cycles are marked at half the thresholds.
+func printHistograms(streams []bitStream, settings decoderSettings) {
+	const barWidth = 40
+	for si, stream := range streams {
+		h := newCycleHistogram(stream.bits)
+		maxCount := 1
+		for _, c := range h.total {
+			maxCount = max(maxCount, c)
+		}
+		fmt.Printf("\nStream %d cycle lengths (samples, bar is l1+l2 on a log scale):\n", si+1)
+		fmt.Printf("%4s %7s %7s %7s\n", "len", "l1", "l2", "l1+l2")
+		for l := 0; l <= maxCycleLength; l++ {
+			mark := ""
+			switch l {
+			case settings.ShortThreshold:
+				mark = " <- short threshold"
+			case settings.LongThreshold:
+				mark = " <- long threshold"
+			case settings.NoSignalThreshold:
+				mark = " <- no signal threshold"
+			}
+			if h.l1[l] == 0 && h.l2[l] == 0 && h.total[l] == 0 && mark == "" {
+				continue
+			}
+			bar := int(math.Log1p(float64(h.total[l])) / math.Log1p(float64(maxCount)) * barWidth)
+			fmt.Printf("%4d %7d %7d %7d %s%-*s%s%s\n", l, h.l1[l], h.l2[l], h.total[l],
+				cycleClassColors[classifyCycle(l, settings)], barWidth, strings.Repeat("#", bar), CLR_0, mark)
+		}
+	}
+}
+
+var histVisible bool
+var histSel int
+
+var thresholdNames = []string{"short", "long", "no signal"}
+
+func thresholdPtr(i int) *int {
+	switch i {
+	case 0:
+		return &proj.Settings.ShortThreshold
+	case 1:
+		return &proj.Settings.LongThreshold
+	}
+	return &proj.Settings.NoSignalThreshold
+}
+
+// moveThreshold moves one of the thresholds, keeping them in order, without
+// decoding the tape again.
+func moveThreshold(i, v int) {
+	s := &proj.Settings
+	switch i {
+	case 0:
+		s.ShortThreshold = max(1, min(s.LongThreshold-1, v))
+	case 1:
+		s.LongThreshold = max(s.ShortThreshold+1, min(s.NoSignalThreshold, v))
+	default:
+		s.NoSignalThreshold = max(s.LongThreshold, min(maxCycleLength-1, v))
+	}
+}
+
+// setThreshold moves one of the thresholds and decodes the tape again with
+// the new settings.
+func setThreshold(i, v int) {
+	moveThreshold(i, v)
+	redecode()
+}
+
+var histLayout struct {
+	x0, colW            int
+	l1Y, l2Y, totalY    int
+	halfH, totalH, axis int
+}
+
+func showHistogram() {
+	if !needAudio("measure the cycles of") {
+		return
+	}
+	histVisible = true
+	redrawHistogram()
+	termbox.Flush()
+}
+
+func hideHistogram() {
+	histVisible = false
+	termbox.Clear(fgCol, bgCol)
+	redrawAll()
+}
+
+// redecode decodes the whole tape again with the project's settings, staying
+// on the program that covers the same part of the tape. If the programs came
+// from a sweep, or one is running, it sweeps again around the new settings
+// and its results replace these when it finishes. If the settings find no
+// programs they are put back as they were, and so are the programs.
+func redecode() {
+	if !needAudio("decode again") {
+		return
+	}
+	start, _ := programSpan(prog)
+	cursor := hexCursor
+	old := proj.Settings
+	proj.Settings.Sweep = false
+	newStreams := readBitStreams(tapeSamples, proj.Settings, ioutil.Discard)
+	newPrograms := readPrograms(newStreams, proj.Settings, ioutil.Discard)
+	if len(newPrograms) == 0 {
+		proj.Settings = old
+		setStatusMessage("No programs found with these settings")
+		redrawHistogram()
+		termbox.Flush()
+		return
+	}
+	applyFixes(newPrograms)
+	placeNotes(newPrograms)
+	streams, programs = newStreams, newPrograms
+	if old.Sweep || sweeping != nil {
+		startSweep()
+		proj.Settings.Sweep = old.Sweep
+	}
+	i := 0
+	for pi, p := range programs {
+		if f, _ := programSpan(p); f <= start {
+			i = pi
+		}
+	}
+	loadProgram(i)
+	moveHexCursor(min(cursor, len(prog.bytes)-1))
+	redrawHistogram()
+	termbox.Flush()
+}
+
+// redrawHistogram draws histograms of the cycle lengths in the current
+// stream over the hex and basic panes, with the thresholds marked on them.
+func redrawHistogram() {
+	if !histVisible {
+		return
+	}
+	top := hexHeaderY
+	for y := top; y < statusY; y++ {
+		for x := 0; x < currentWidth; x++ {
+			termbox.SetCell(x, y, ' ', fgCol, bgCol)
+		}
+	}
+
+	// Thresholds and how many problems they leave.
+	tbPrint(0, top, fgCol, bgCol, " Thresholds:")
+	x := 12
+	for i, name := range thresholdNames {
+		fg := fgCol
+		if i == histSel {
+			fg = curCol | termbox.AttrReverse
+		}
+		text := fmt.Sprintf(" %s %d ", name, *thresholdPtr(i))
+		tbPrint(x+1, top, fg, bgCol, text)
+		x = x + 1 + len(text)
+	}
+	tbPrint(x+2, top, termbox.ColorBlue, bgCol, fmt.Sprintf("%s selects, %s / %s move, or drag",
+		keysFor("next-pane"), keysFor("left"), keysFor("right")))
+	var counts []string
+	for kind, name := range problemNames {
+		n := 0
+		for _, p := range programs {
+			n += len(problemBytes(p, problemKind(kind)))
+		}
+		counts = append(counts, fmt.Sprintf("%d %ss", n, name))
+	}
+	tbPrint(0, top+1, fgCol, bgCol, fmt.Sprintf(" %d streams, %d programs: %s",
+		len(streams), len(programs), strings.Join(counts, ", ")))
+
+	l := &histLayout
+	rows := statusY - top - 2 - 4
+	l.totalH = max(1, rows/2)
+	l.halfH = max(1, (rows-l.totalH)/2)
+	l.l1Y = top + 3
+	l.l2Y = l.l1Y + l.halfH + 1
+	l.totalY = l.l2Y + l.halfH + 1
+	l.axis = l.totalY + l.totalH
+	l.x0 = 1
+	l.colW = max(1, (currentWidth-2)/(maxCycleLength+1))
+
+	h := newCycleHistogram(prog.stream.bits)
+	drawHistogram(h.l1, l.l1Y, l.halfH, 2, "l1: high half cycle (thresholds halved)")
+	drawHistogram(h.l2, l.l2Y, l.halfH, 2, "l2: low half cycle (thresholds halved)")
+	drawHistogram(h.total, l.totalY, l.totalH, 1, "l1+l2: whole cycle (log scale)")
+	for length := 0; length <= maxCycleLength; length += 10 {
+		tbPrint(l.x0+length*l.colW, l.axis, fgCol, bgCol, fmt.Sprintf("%d", length))
+	}
+}
+
+var cycleClassAttrs = []termbox.Attribute{termbox.ColorGreen, termbox.ColorYellow, termbox.ColorBlue, termbox.ColorRed}
+
+// drawHistogram draws one histogram with its label above it. Lengths are
+// multiplied by scale to decide their class, so half cycles are coloured
+// and marked at half the thresholds.
+func drawHistogram(counts []int, y0, height, scale int, label string) {
+	l := histLayout
+	tbPrint(l.x0, y0-1, fgCol|termbox.AttrBold, bgCol, label)
+	maxCount := 1
+	for _, c := range counts {
+		maxCount = max(maxCount, c)
+	}
+	for length, c := range counts {
+		eighths := 0
+		if c > 0 {
+			eighths = max(1, int(math.Log1p(float64(c))/math.Log1p(float64(maxCount))*float64(height*8)))
+		}
+		fg := cycleClassAttrs[classifyCycle(length*scale, proj.Settings)]
+		for row := 0; row < height; row++ {
+			r := ' '
+			if n := eighths - (height-1-row)*8; n >= 8 {
+				r = heatRunes[8]
+			} else if n > 0 {
+				r = heatRunes[n]
+			}
+			for cx := 0; cx < max(1, l.colW-1); cx++ {
+				termbox.SetCell(l.x0+length*l.colW+cx, y0+row, r, fg, bgCol)
+			}
+		}
+	}
+
+	// Mark the thresholds between the columns they separate, wherever the
+	// bars leave room.
+	for i := range thresholdNames {
+		boundary := *thresholdPtr(i)
+		if i == 1 {
+			boundary--
+		}
+		boundary = boundary / scale
+		fg := termbox.ColorMagenta
+		if i == histSel {
+			fg = curCol | termbox.AttrBold
+		}
+		x := l.x0 + boundary*l.colW + l.colW - 1
+		if x >= currentWidth {
+			continue
+		}
+		for row := 0; row < height; row++ {
+			if c := termbox.CellBuffer()[(y0+row)*currentWidth+x]; c.Ch == ' ' || c.Ch == 0 {
+				termbox.SetCell(x, y0+row, '│', fg, bgCol)
+			}
+		}
+	}
+}
+
+// histLengthAt returns the cycle length under a point in the histograms, or
+// -1 if it is not over one.
+func histLengthAt(x, y int) int {
+	l := histLayout
+	if x < l.x0 || y < l.l1Y || y >= l.axis {
+		return -1
+	}
+	length := (x - l.x0) / l.colW
+	if y < l.totalY-1 {
+		length = length * 2
+	}
+	return min(maxCycleLength, length)
+}
+
+func handleHistogramKey(ev termbox.Event) {
+	if ev.Key == termbox.KeyEsc || ev.Key == termbox.KeyEnter {
+		hideHistogram()
+		return
+	}
+	switch bindings[keySpec{ev.Key, ev.Ch}] {
+	case "quit", "histogram", "help":
+		hideHistogram()
+	case "next-pane", "down":
+		histSel = (histSel + 1) % len(thresholdNames)
+		redrawHistogram()
+		termbox.Flush()
+	case "prev-pane", "up":
+		histSel = (histSel + len(thresholdNames) - 1) % len(thresholdNames)
+		redrawHistogram()
+		termbox.Flush()
+	case "left":
+		setThreshold(histSel, *thresholdPtr(histSel)-1)
+	case "right":
+		setThreshold(histSel, *thresholdPtr(histSel)+1)
+	}
+}
+
+var histDragged bool
+
+// handleHistogramMouse picks the threshold nearest to a click and drags it.
+// The tape is only decoded again when the button is let go, as decoding can
+// take longer than the mouse takes to move.
+func handleHistogramMouse(ev termbox.Event) {
+	if ev.Key == termbox.MouseRelease {
+		if histDragged {
+			histDragged = false
+			redecode()
+		}
+		return
+	}
+	if ev.Key != termbox.MouseLeft {
+		return
+	}
+	length := histLengthAt(ev.MouseX, ev.MouseY)
+	if length < 0 {
+		return
+	}
+	if ev.Mod&termbox.ModMotion == 0 {
+		for i := range thresholdNames {
+			if abs(*thresholdPtr(i)-length) < abs(*thresholdPtr(histSel)-length) {
+				histSel = i
+			}
+		}
+	}
+	if length != *thresholdPtr(histSel) {
+		moveThreshold(histSel, length)
+		histDragged = true
+		redrawHistogram()
+		termbox.Flush()
+	}
+}
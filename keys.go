@@ -0,0 +1,410 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type action struct {
+	name string
+	help string
+	run  func()
+}
+
+// The actions that keys can be bound to, in the order they are listed on the
+// help screen. Help and quit are handled by the main loop itself.
+var actionList = []action{
+	{"help", "Show this help", nil},
+	{"quit", "Quit", nil},
+	{"next-pane", "Move focus to the next pane", func() { setFocus(nextPane(1)) }},
+	{"prev-pane", "Move focus to the previous pane", func() { setFocus(nextPane(-1)) }},
+	{"left", "Move left / scroll Basic left / pan wave left, or a cycle at cycle zoom", func() { moveInPane(motionLeft) }},
+	{"right", "Move right / scroll Basic right / pan wave right, or a cycle at cycle zoom", func() { moveInPane(motionRight) }},
+	{"up", "Move up / zoom wave in", func() { moveInPane(motionUp) }},
+	{"down", "Move down / zoom wave out", func() { moveInPane(motionDown) }},
+	{"page-up", "Page up", func() { moveInPane(motionPageUp) }},
+	{"page-down", "Page down", func() { moveInPane(motionPageDown) }},
+	{"home", "Go to start / reset wave pan", func() { moveInPane(motionHome) }},
+	{"end", "Go to end", func() { moveInPane(motionEnd) }},
+	{"zoom-in", "Zoom wave in", func() { zoomWav(-1) }},
+	{"zoom-out", "Zoom wave out", func() { zoomWav(1) }},
+	{"pan-left", "Pan wave left", func() { panWav(-1) }},
+	{"pan-right", "Pan wave right", func() { panWav(1) }},
+	{"search", "Search ($hex, :line or text)", startSearch},
+	{"search-next", "Next search match", func() { repeatSearch(1) }},
+	{"search-prev", "Previous search match", func() { repeatSearch(-1) }},
+	{"next-chkerr", "Next checksum error", func() { nextProblem(problemChkErr, 1) }},
+	{"prev-chkerr", "Previous checksum error", func() { nextProblem(problemChkErr, -1) }},
+	{"next-unclear", "Next unclear byte", func() { nextProblem(problemUnclear, 1) }},
+	{"prev-unclear", "Previous unclear byte", func() { nextProblem(problemUnclear, -1) }},
+	{"next-lenerr", "Next line length error", func() { nextProblem(problemLenErr, 1) }},
+	{"prev-lenerr", "Previous line length error", func() { nextProblem(problemLenErr, -1) }},
+	{"next-suspect", "Next suspect line of Basic", func() { nextProblem(problemSuspect, 1) }},
+	{"prev-suspect", "Previous suspect line of Basic", func() { nextProblem(problemSuspect, -1) }},
+	{"prev-program", "Previous program on the tape", previousProgram},
+	{"next-program", "Next program on the tape", nextProgram},
+	{"toggle-bookmark", "Set or clear a bookmark on the byte", toggleBookmark},
+	{"add-note", "Add a note (or edit it in the notes panel)", newNote},
+	{"delete-note", "Delete the notes here", deleteNote},
+	{"toggle-notes", "Show or hide the notes panel", toggleNotes},
+	{"next-note", "Next note or bookmark", func() { nextNote(1) }},
+	{"prev-note", "Previous note or bookmark", func() { nextNote(-1) }},
+	{"save-project", "Save the project file", saveSession},
+	{"histogram", "Show cycle lengths and tune the thresholds", showHistogram},
+	{"next-demodulator", "Read this stream with the next demodulator", nextDemodulator},
+	{"toggle-framing", "Switch between simple and Viterbi byte framing", toggleFraming},
+	{"suggest", "Suggest values for the byte under the cursor", toggleSuggestions},
+	{"toggle-overlay", "Show or hide how the peak search read each cycle", toggleOverlay},
+	{"sweep", "Sweep decoder settings for the best decode (or stop)", toggleSweep},
+	{"stream-list", "List the streams and fragments on the tape", toggleStreamList},
+	{"export-report", "Write an html report next to the project file", exportReport},
+	{"export-trace", "Write a CSV trace of the cycles in the wave pane next to the project file", exportTrace},
+	{"preview-image", "Show a screen or character set saved on the tape", togglePreview},
+	{"export-listing", "Write an indented listing and cross reference next to the project file", exportListing},
+}
+
+var actions = map[string]action{}
+
+func init() {
+	for _, a := range actionList {
+		actions[a.name] = a
+	}
+	if err := applyKeyConfig("preset default"); err != nil {
+		panic(err)
+	}
+}
+
+type keySpec struct {
+	key termbox.Key
+	ch  rune
+}
+
+var bindings = map[keySpec]string{}
+
+var keyNames = map[string]termbox.Key{
+	"Esc": termbox.KeyEsc, "Tab": termbox.KeyTab, "Enter": termbox.KeyEnter,
+	"Space": termbox.KeySpace, "Backspace": termbox.KeyBackspace2,
+	"Left": termbox.KeyArrowLeft, "Right": termbox.KeyArrowRight,
+	"Up": termbox.KeyArrowUp, "Down": termbox.KeyArrowDown,
+	"PgUp": termbox.KeyPgup, "PgDn": termbox.KeyPgdn,
+	"Home": termbox.KeyHome, "End": termbox.KeyEnd,
+	"Insert": termbox.KeyInsert, "Delete": termbox.KeyDelete,
+	"F1": termbox.KeyF1, "F2": termbox.KeyF2, "F3": termbox.KeyF3, "F4": termbox.KeyF4,
+	"F5": termbox.KeyF5, "F6": termbox.KeyF6, "F7": termbox.KeyF7, "F8": termbox.KeyF8,
+	"F9": termbox.KeyF9, "F10": termbox.KeyF10, "F11": termbox.KeyF11, "F12": termbox.KeyF12,
+}
+
+// parseKey parses a key name such as "PgUp", "Ctrl-B" or "n".
+func parseKey(name string) (k keySpec, err error) {
+	if key, ok := keyNames[name]; ok {
+		return keySpec{key: key}, nil
+	}
+	if strings.HasPrefix(name, "Ctrl-") && len(name) == 6 {
+		c := strings.ToUpper(name)[5]
+		if c >= 'A' && c <= 'Z' {
+			return keySpec{key: termbox.KeyCtrlA + termbox.Key(c-'A')}, nil
+		}
+	}
+	if r := []rune(name); len(r) == 1 {
+		return keySpec{ch: r[0]}, nil
+	}
+	return k, fmt.Errorf("unknown key %q", name)
+}
+
+func (k keySpec) String() string {
+	if k.ch != 0 {
+		return string(k.ch)
+	}
+	for name, key := range keyNames {
+		if key == k.key {
+			return name
+		}
+	}
+	if k.key >= termbox.KeyCtrlA && k.key <= termbox.KeyCtrlZ {
+		return "Ctrl-" + string(rune('A'+k.key-termbox.KeyCtrlA))
+	}
+	return fmt.Sprintf("Key%d", k.key)
+}
+
+// keysFor returns the keys bound to an action, for showing to the user.
+func keysFor(name string) string {
+	var keys []string
+	for k, a := range bindings {
+		if a == name {
+			keys = append(keys, k.String())
+		}
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, " ")
+}
+
+// Key binding presets, written in the same form as the config file. The vi
+// and emacs presets are applied on top of the default one.
+var presets = map[string]string{
+	"default": `
+		F1 help
+		? help
+		Esc quit
+		Tab next-pane
+		Left left
+		Ctrl-B left
+		Right right
+		Ctrl-F right
+		Up up
+		Down down
+		PgUp page-up
+		PgDn page-down
+		Home home
+		End end
+		+ zoom-in
+		= zoom-in
+		- zoom-out
+		< pan-left
+		, pan-left
+		> pan-right
+		. pan-right
+		/ search
+		n search-next
+		N search-prev
+		e next-chkerr
+		E prev-chkerr
+		u next-unclear
+		U prev-unclear
+		l next-lenerr
+		L prev-lenerr
+		b next-suspect
+		B prev-suspect
+		[ prev-program
+		] next-program
+		m toggle-bookmark
+		a add-note
+		D delete-note
+		A toggle-notes
+		' next-note
+		" prev-note
+		S save-project
+		R export-report
+		X export-trace
+		P export-listing
+		I preview-image
+		H histogram
+		M next-demodulator
+		V toggle-framing
+		O toggle-overlay
+		F suggest
+		W sweep
+		T stream-list`,
+	"vi": `
+		preset default
+		q quit
+		h left
+		j down
+		k up
+		l right
+		Ctrl-B page-up
+		Ctrl-F page-down
+		g home
+		G end
+		} next-lenerr
+		{ prev-lenerr`,
+	"emacs": `
+		preset default
+		Ctrl-G quit
+		Ctrl-B left
+		Ctrl-F right
+		Ctrl-P up
+		Ctrl-N down
+		Ctrl-V page-down
+		Ctrl-Z page-up
+		Ctrl-A home
+		Ctrl-E end
+		Ctrl-S search
+		Ctrl-R search-prev`,
+}
+
+// applyKeyConfig applies key bindings written one per line as a key name
+// followed by an action name, or "none" to unbind the key. A line of the form
+// "preset <name>" starts again from one of the presets. Blank lines and lines
+// starting with # are ignored.
+func applyKeyConfig(config string) error {
+	for i, line := range strings.Split(config, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expected a key and an action", i+1)
+		}
+		if fields[0] == "preset" {
+			preset, ok := presets[fields[1]]
+			if !ok {
+				return fmt.Errorf("line %d: unknown preset %q", i+1, fields[1])
+			}
+			bindings = map[keySpec]string{}
+			if err := applyKeyConfig(preset); err != nil {
+				return err
+			}
+			continue
+		}
+		k, err := parseKey(fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %s", i+1, err)
+		}
+		if fields[1] == "none" {
+			delete(bindings, k)
+			continue
+		}
+		if _, ok := actions[fields[1]]; !ok {
+			return fmt.Errorf("line %d: unknown action %q", i+1, fields[1])
+		}
+		bindings[k] = fields[1]
+	}
+	return nil
+}
+
+// loadKeyConfig reads key bindings from ~/.orictaperc, if there is one.
+func loadKeyConfig() error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	fileName := filepath.Join(home, ".orictaperc")
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var config []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		config = append(config, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if err = applyKeyConfig(strings.Join(config, "\n")); err != nil {
+		return fmt.Errorf("%s: %s", fileName, err)
+	}
+	return nil
+}
+
+var helpVisible bool
+var helpTop int
+
+// showHelp draws a box over the panes listing every action and its keys.
+func showHelp() {
+	helpVisible = true
+	helpTop = 0
+	redrawHelp()
+	termbox.Flush()
+}
+
+// helpRows returns how many actions fit in the help box at once.
+func helpRows() int {
+	return max(1, min(currentHeight-2, len(actionList)+4)-4)
+}
+
+func redrawHelp() {
+	w := min(currentWidth-2, 72)
+	rows := helpRows()
+	helpTop = max(0, min(len(actionList)-rows, helpTop))
+	h := rows + 4
+	x0 := (currentWidth - w) / 2
+	y0 := (currentHeight - h) / 2
+
+	for y := y0; y < y0+h; y++ {
+		for x := x0; x < x0+w; x++ {
+			termbox.SetCell(x, y, ' ', termbox.ColorWhite, termbox.ColorBlue)
+		}
+	}
+	tbPrint(x0+2, y0, termbox.ColorWhite|termbox.AttrBold, termbox.ColorBlue, "Keys")
+	for i := 0; i < rows && helpTop+i < len(actionList); i++ {
+		a := actionList[helpTop+i]
+		keys := keysFor(a.name)
+		if keys == "" {
+			keys = "-"
+		}
+		tbPrint(x0+2, y0+2+i, termbox.ColorYellow, termbox.ColorBlue, keys)
+		help := a.help
+		if len(help) > w-24 {
+			help = help[:max(0, w-24)]
+		}
+		tbPrint(x0+22, y0+2+i, termbox.ColorWhite, termbox.ColorBlue, help)
+	}
+	footer := "Press any key to close"
+	if rows < len(actionList) {
+		footer = fmt.Sprintf("%d to %d of %d, %s and %s scroll, any other key closes",
+			helpTop+1, min(helpTop+rows, len(actionList)), len(actionList), keysFor("up"), keysFor("down"))
+	}
+	tbPrint(x0+2, y0+h-1, termbox.ColorWhite, termbox.ColorBlue, footer)
+}
+
+// scrollHelp moves the list of actions by n rows, keeping the box full.
+func scrollHelp(n int) {
+	helpTop = max(0, min(len(actionList)-helpRows(), helpTop+n))
+	redrawHelp()
+	termbox.Flush()
+}
+
+// handleHelpKey scrolls the list of actions, and closes it on any other key.
+func handleHelpKey(ev termbox.Event) {
+	switch bindings[keySpec{ev.Key, ev.Ch}] {
+	case "up":
+		scrollHelp(-1)
+	case "down":
+		scrollHelp(1)
+	case "page-up":
+		scrollHelp(-helpRows())
+	case "page-down":
+		scrollHelp(helpRows())
+	case "home":
+		scrollHelp(-len(actionList))
+	case "end":
+		scrollHelp(len(actionList))
+	default:
+		hideHelp()
+	}
+}
+
+// handleHelpMouse scrolls the list of actions with the wheel, and closes it
+// on a click.
+func handleHelpMouse(ev termbox.Event) {
+	switch ev.Key {
+	case termbox.MouseWheelUp:
+		scrollHelp(-3)
+	case termbox.MouseWheelDown:
+		scrollHelp(3)
+	case termbox.MouseLeft:
+		if ev.Mod&termbox.ModMotion == 0 {
+			hideHelp()
+		}
+	}
+}
+
+func hideHelp() {
+	helpVisible = false
+	termbox.Clear(fgCol, bgCol)
+	redrawAll()
+}
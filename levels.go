@@ -0,0 +1,162 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Samples this close to the limits of an int16, this many in a row, have
+// been clipped.
+const clipLevel = 32700
+const minClipRun = 3
+
+// A stream that swings less than this from peak to peak (about -30 dBFS) was
+// recorded too quietly to leave any room for the noise.
+const quietSwing = 2048
+
+// How far, as a fraction of half the swing, the middle of the signal can be
+// off zero, or wander, before it is worth mentioning.
+const maxOffset = 0.1
+
+// The middle of the signal is measured over stretches this long (0.1s) to see
+// whether it drifts.
+const driftWindow = 4410
+
+// captureQuality describes how well a stream was recorded.
+type captureQuality struct {
+	clippedRuns    int
+	clippedSamples int
+	swing          int     // peak to peak
+	offset         float64 // of the middle from zero, as a fraction of half the swing
+	drift          float64 // of the middle along the stream, likewise
+}
+
+// measureQuality looks for clipping, a low level, a DC offset and drift in a
+// stream, and marks the bits that were clipped.
+func measureQuality(stream *bitStream) {
+	q := captureQuality{swing: int(stream.maxVal) - int(stream.minVal)}
+	samples := stream.samples[stream.firstSample:min(stream.lastSample+1, len(stream.samples))]
+	if len(samples) == 0 || q.swing <= 0 {
+		stream.quality = q
+		return
+	}
+	half := float64(q.swing) / 2
+
+	var sum, windowSum float64
+	minMean, maxMean := math.Inf(1), math.Inf(-1)
+	bi := 0
+	run := 0
+	for i, v := range samples {
+		sum += float64(v)
+		windowSum += float64(v)
+		if n := i%driftWindow + 1; n == driftWindow || len(samples) < driftWindow && i == len(samples)-1 {
+			minMean = math.Min(minMean, windowSum/float64(n))
+			maxMean = math.Max(maxMean, windowSum/float64(n))
+			windowSum = 0
+		}
+
+		if v >= clipLevel || v <= -clipLevel {
+			run++
+			continue
+		}
+		if run >= minClipRun {
+			q.clippedRuns++
+			q.clippedSamples += run
+			bi = markClipped(stream.bits, bi, stream.firstSample+i-run, stream.firstSample+i-1)
+		}
+		run = 0
+	}
+	if run >= minClipRun {
+		q.clippedRuns++
+		q.clippedSamples += run
+		markClipped(stream.bits, bi, stream.firstSample+len(samples)-run, stream.firstSample+len(samples)-1)
+	}
+
+	q.offset = sum / float64(len(samples)) / half
+	q.drift = (maxMean - minMean) / half
+	stream.quality = q
+}
+
+// markClipped marks the bits, from the given one on, that overlap a run of
+// clipped samples. It returns the first bit to look at for the next run.
+func markClipped(bits []bitInfo, from, first, last int) int {
+	for from < len(bits) && bits[from].lastSample < first {
+		from++
+	}
+	for i := from; i < len(bits) && bits[i].firstSample <= last; i++ {
+		bits[i].clipped = true
+	}
+	return from
+}
+
+// qualityProblems describes what is wrong with how a stream was recorded,
+// and what to do about it.
+func qualityProblems(q captureQuality) (problems []string) {
+	if q.clippedRuns > 0 {
+		problems = append(problems, fmt.Sprintf("clipped in %d places (%d samples): re-record with the level turned down",
+			q.clippedRuns, q.clippedSamples))
+	}
+	if q.swing > 0 && q.swing < quietSwing {
+		problems = append(problems, fmt.Sprintf("very quiet, peaking at %.0f dBFS: re-record with the level turned up",
+			20*math.Log10(float64(q.swing)/65536)))
+	}
+	if math.Abs(q.offset) > maxOffset {
+		problems = append(problems, fmt.Sprintf("off centre by %.0f%% of its swing: check for a DC offset in the recording chain",
+			math.Abs(q.offset)*100))
+	}
+	if q.drift > maxOffset {
+		problems = append(problems, fmt.Sprintf("its centre drifts by %.0f%% of its swing: check for hum or a DC coupled input",
+			q.drift*100))
+	}
+	return
+}
+
+// qualitySummary is a few words on what is wrong with how a stream was
+// recorded, for the wave header.
+func qualitySummary(q captureQuality) string {
+	var words []string
+	if q.clippedRuns > 0 {
+		words = append(words, "clipped")
+	}
+	if q.swing > 0 && q.swing < quietSwing {
+		words = append(words, "quiet")
+	}
+	if math.Abs(q.offset) > maxOffset {
+		words = append(words, "off centre")
+	}
+	if q.drift > maxOffset {
+		words = append(words, "drifting")
+	}
+	return strings.Join(words, ", ")
+}
+
+// printCaptureQuality sums up how well each stream was recorded.
+func printCaptureQuality(w io.Writer, streams []bitStream) {
+	fmt.Fprintf(w, "Capture quality:\n")
+	ok := true
+	for i, stream := range streams {
+		for _, p := range qualityProblems(stream.quality) {
+			fmt.Fprintf(w, " %s%d) %s%s\n", CLR_Y, i, p, CLR_0)
+			ok = false
+		}
+	}
+	if ok {
+		fmt.Fprintf(w, " %sThe levels look fine%s\n", CLR_G, CLR_0)
+	}
+}
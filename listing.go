@@ -0,0 +1,493 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type basicTokenKind int
+
+const (
+	tokenKeyword basicTokenKind = iota
+	tokenName
+	tokenNumber
+	tokenString
+	tokenText // the rest of a REM or DATA statement
+	tokenPunct
+)
+
+type basicToken struct {
+	kind basicTokenKind
+	text string
+}
+
+// Keywords longer than one character; the one character ones list the same
+// as the characters they stand for.
+var longKeywords = func() map[string]bool {
+	m := map[string]bool{}
+	for _, k := range keywords {
+		if len(k) > 1 {
+			m[k] = true
+		}
+	}
+	return m
+}()
+
+func isLetter(s string) bool {
+	return len(s) == 1 && s[0] >= 'A' && s[0] <= 'Z'
+}
+
+func isDigit(s string) bool {
+	return len(s) == 1 && s[0] >= '0' && s[0] <= '9'
+}
+
+// lexLine splits the elements of a line into statements of tokens, dropping
+// the spaces between them.
+func lexLine(l lineInfo) (number string, statements [][]basicToken) {
+	if len(l.elements) == 0 {
+		return
+	}
+	number = strings.TrimSpace(l.elements[0])
+	els := make([]string, len(l.elements)-1)
+	for i, el := range l.elements[1:] {
+		els[i] = ansiEscapes.ReplaceAllString(el, "")
+	}
+	var st []basicToken
+	for i := 0; i < len(els); i++ {
+		el := els[i]
+		switch {
+		case el == "\"":
+			text := el
+			for i++; i < len(els) && els[i] != "\""; i++ {
+				text = text + els[i]
+			}
+			if i < len(els) {
+				text = text + "\""
+			}
+			st = append(st, basicToken{tokenString, text})
+		case el == ":":
+			statements = append(statements, st)
+			st = nil
+		case el == " ":
+		case longKeywords[el]:
+			st = append(st, basicToken{tokenKeyword, el})
+			if el == "REM" || el == "DATA" {
+				text, quoted := "", false
+				for i++; i < len(els) && (el == "REM" || quoted || els[i] != ":"); i++ {
+					quoted = quoted != (els[i] == "\"")
+					text = text + els[i]
+				}
+				i--
+				if text = strings.TrimSpace(text); text != "" {
+					st = append(st, basicToken{tokenText, text})
+				}
+			}
+		case isLetter(el):
+			name := el
+			for i++; i < len(els) && (isLetter(els[i]) || isDigit(els[i])); i++ {
+				name = name + els[i]
+			}
+			if i < len(els) && (els[i] == "$" || els[i] == "%") {
+				name = name + els[i]
+				i++
+			}
+			i--
+			if longKeywords[name] {
+				// Stored as letters, but Basic reads it as the keyword.
+				st = append(st, basicToken{tokenKeyword, name})
+			} else {
+				st = append(st, basicToken{tokenName, name})
+			}
+		case isDigit(el), el == ".", el == "#":
+			text := el
+			for i++; i < len(els) && (isDigit(els[i]) || els[i] == "." || el == "#" && strings.Contains("ABCDEF", els[i])); i++ {
+				text = text + els[i]
+			}
+			i--
+			st = append(st, basicToken{tokenNumber, text})
+		default:
+			st = append(st, basicToken{tokenPunct, el})
+		}
+	}
+	return number, append(statements, st)
+}
+
+func (t basicToken) isOperator() bool {
+	return t.kind == tokenPunct && len(t.text) == 1 && strings.Contains("+-*/^=<>", t.text) ||
+		t.kind == tokenKeyword && (t.text == "AND" || t.text == "OR" || t.text == "NOT")
+}
+
+func (t basicToken) isFunction() bool {
+	return t.kind == tokenKeyword && tokenFor(t.text) >= firstFunction
+}
+
+// spaced says whether to put a space between two tokens, given the one
+// before them (or nil at the start of a statement).
+func spaced(before *basicToken, prev, t basicToken) bool {
+	switch {
+	case t.kind == tokenPunct && strings.Contains("),;", t.text),
+		prev.kind == tokenPunct && prev.text == "(",
+		strings.HasSuffix(prev.text, "("),
+		t.text == "(" && (prev.kind == tokenName || prev.isFunction()),
+		t.text == "$" || t.text == "%":
+		return false
+	case prev.kind == tokenPunct && strings.Contains("<>", prev.text) && t.kind == tokenPunct && strings.Contains("<>=", t.text):
+		// <>, <= and >= are two tokens.
+		return false
+	case prev.kind == tokenPunct && (prev.text == "-" || prev.text == "+"):
+		// No space after a sign.
+		return before != nil && !before.isOperator() && !(before.kind == tokenPunct && strings.Contains("(,;", before.text)) &&
+			!(before.kind == tokenKeyword && !before.isFunction())
+	}
+	return true
+}
+
+// prettyStatement writes a statement with spaces between its tokens.
+func prettyStatement(st []basicToken) string {
+	var b strings.Builder
+	for i, t := range st {
+		if i > 0 {
+			var before *basicToken
+			if i > 1 {
+				before = &st[i-2]
+			}
+			if spaced(before, st[i-1], t) {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
+
+// loopChange returns how many loops a statement opens (FOR, REPEAT) or
+// closes (NEXT, UNTIL, negative).
+func loopChange(st []basicToken) int {
+	if len(st) == 0 || st[0].kind != tokenKeyword {
+		return 0
+	}
+	switch st[0].text {
+	case "FOR", "REPEAT":
+		return 1
+	case "UNTIL":
+		return -1
+	case "NEXT":
+		n := 1
+		for _, t := range st[1:] {
+			if t.text == "," {
+				n++
+			}
+		}
+		return -n
+	}
+	return 0
+}
+
+// prettyListing lists a program with spaces between the tokens, and with the
+// bodies of FOR and REPEAT loops indented.
+func prettyListing(p program) (lines []string) {
+	depth := 0
+	for _, l := range p.lines {
+		number, statements := lexLine(l)
+		indent := depth
+		leading := true
+		var texts []string
+		for _, st := range statements {
+			change := loopChange(st)
+			if leading && change < 0 {
+				indent = max(0, indent+change)
+			} else {
+				leading = false
+			}
+			depth = max(0, depth+change)
+			texts = append(texts, prettyStatement(st))
+		}
+		lines = append(lines, fmt.Sprintf("%5s %s%s", number, strings.Repeat("  ", indent), strings.Join(texts, " : ")))
+	}
+	return
+}
+
+// A listingRef is where a line number, variable or DATA statement is used:
+// the line, and how.
+type listingRef struct {
+	line string
+	how  string
+}
+
+// A crossRef says where each variable is set and used, which lines jump to
+// which, and where DATA is kept and read.
+type crossRef struct {
+	sets, uses          map[string][]string
+	jumps               map[int][]listingRef
+	lines               map[int]bool
+	data, reads, others []listingRef
+}
+
+// crossReference works out a program's cross reference from its lines.
+func crossReference(p program) (x crossRef) {
+	x.sets, x.uses = map[string][]string{}, map[string][]string{}
+	x.jumps, x.lines = map[int][]listingRef{}, map[int]bool{}
+	add := func(m map[string][]string, name, line string) {
+		if refs := m[name]; len(refs) == 0 || refs[len(refs)-1] != line {
+			m[name] = append(refs, line)
+		}
+	}
+	for _, l := range p.lines {
+		number, statements := lexLine(l)
+		if n, err := strconv.Atoi(number); err == nil {
+			x.lines[n] = true
+		}
+		for _, st := range statements {
+			// The statements that set the variables they name: the one
+			// at setAt, or all of them.
+			setAt, all := -1, false
+			if len(st) > 0 && st[0].kind == tokenName {
+				setAt = 0
+			} else if len(st) > 1 && st[0].kind == tokenKeyword {
+				switch st[0].text {
+				case "LET", "FOR":
+					setAt = 1
+				case "DEF":
+					setAt = 2
+				case "READ", "INPUT", "GET", "DIM":
+					all = true
+				}
+			}
+
+			var jump string
+			for i, t := range st {
+				name := t.text
+				if t.kind == tokenName && i+1 < len(st) && st[i+1].text == "(" {
+					name = name + "()"
+				}
+				if t.kind == tokenName && i > 0 && st[i-1].text == "FN" {
+					name = "FN " + name
+				}
+				switch {
+				case t.kind == tokenName && (all || i == setAt):
+					add(x.sets, name, number)
+				case t.kind == tokenName:
+					add(x.uses, name, number)
+				case t.kind == tokenKeyword && (t.text == "GOTO" || t.text == "GOSUB" || t.text == "THEN" || t.text == "ELSE"):
+					jump = t.text
+					continue
+				case t.kind == tokenNumber && jump != "":
+					r := listingRef{number, jump}
+					if n, err := strconv.Atoi(t.text); err == nil && (len(x.jumps[n]) == 0 || x.jumps[n][len(x.jumps[n])-1] != r) {
+						x.jumps[n] = append(x.jumps[n], r)
+					}
+					continue
+				case t.text == "," && jump != "":
+					continue
+				}
+				jump = ""
+			}
+
+			if len(st) == 0 || st[0].kind != tokenKeyword {
+				continue
+			}
+			switch st[0].text {
+			case "DATA":
+				items := 0
+				if len(st) > 1 {
+					items = 1
+					quoted := false
+					for _, c := range st[1].text {
+						quoted = quoted != (c == '"')
+						if c == ',' && !quoted {
+							items++
+						}
+					}
+				}
+				x.data = append(x.data, listingRef{number, fmt.Sprintf("%d items", items)})
+			case "READ":
+				var names []string
+				for _, t := range st[1:] {
+					if t.kind == tokenName {
+						names = append(names, t.text)
+					}
+				}
+				x.reads = append(x.reads, listingRef{number, strings.Join(names, ", ")})
+			case "RESTORE":
+				x.others = append(x.others, listingRef{number, "RESTORE"})
+			}
+		}
+	}
+	return
+}
+
+// text writes the cross reference as plain text.
+func (x crossRef) text() (lines []string) {
+	lines = append(lines, "Variables")
+	var names []string
+	for name := range x.sets {
+		names = append(names, name)
+	}
+	for name := range x.uses {
+		if _, ok := x.sets[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := fmt.Sprintf("  %-8s", name)
+		if refs := x.sets[name]; len(refs) > 0 {
+			s = s + " set " + strings.Join(refs, " ")
+		} else {
+			s = s + " never set"
+		}
+		if refs := x.uses[name]; len(refs) > 0 {
+			s = s + "; used " + strings.Join(refs, " ")
+		} else {
+			s = s + "; never used"
+		}
+		lines = append(lines, s)
+	}
+	if len(names) == 0 {
+		lines = append(lines, "  none")
+	}
+
+	lines = append(lines, "", "Line numbers jumped to")
+	var targets []int
+	for n := range x.jumps {
+		targets = append(targets, n)
+	}
+	sort.Ints(targets)
+	for _, n := range targets {
+		var from []string
+		for _, r := range x.jumps[n] {
+			from = append(from, fmt.Sprintf("%s (%s)", r.line, r.how))
+		}
+		s := fmt.Sprintf("  %-8d from %s", n, strings.Join(from, ", "))
+		if !x.lines[n] {
+			s = s + "; no such line"
+		}
+		lines = append(lines, s)
+	}
+	if len(targets) == 0 {
+		lines = append(lines, "  none")
+	}
+
+	lines = append(lines, "", "DATA and READ")
+	for _, group := range []struct {
+		name string
+		refs []listingRef
+	}{{"DATA", x.data}, {"READ", x.reads}, {"RESTORE", x.others}} {
+		var refs []string
+		for _, r := range group.refs {
+			if r.how == group.name {
+				refs = append(refs, r.line)
+			} else {
+				refs = append(refs, fmt.Sprintf("%s (%s)", r.line, r.how))
+			}
+		}
+		if len(refs) > 0 {
+			lines = append(lines, fmt.Sprintf("  %-8s %s", group.name, strings.Join(refs, ", ")))
+		}
+	}
+	if len(x.data)+len(x.reads)+len(x.others) == 0 {
+		lines = append(lines, "  none")
+	}
+	return
+}
+
+// programListing returns the sections of a program's listing, each a title
+// and its lines: the listing itself, indented if asked, then the cross
+// reference.
+func programListing(p program, indent bool) (titles []string, sections [][]string) {
+	var listing []string
+	if indent {
+		listing = prettyListing(p)
+	} else {
+		for _, l := range p.lines {
+			listing = append(listing, ansiEscapes.ReplaceAllString(l.v, ""))
+		}
+	}
+	return []string{"Listing", "Cross reference"}, [][]string{listing, crossReference(p).text()}
+}
+
+// writeListing writes the listing and cross reference of every program to a
+// file, as html if its name ends in .html and as text otherwise.
+func writeListing(fileName string, programs []program, indent bool) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	lower := strings.ToLower(fileName)
+	if strings.HasSuffix(lower, ".html") || strings.HasSuffix(lower, ".htm") {
+		writeListingHTML(w, programs, indent)
+	} else {
+		writeListingText(w, programs, indent)
+	}
+	return w.Flush()
+}
+
+func writeListingText(w io.Writer, programs []program, indent bool) {
+	for pi, p := range programs {
+		if len(p.lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "Program %d \"%s\"\n", pi+1, p.name)
+		titles, sections := programListing(p, indent)
+		for i, title := range titles {
+			fmt.Fprintf(w, "\n%s\n\n", title)
+			for _, line := range sections[i] {
+				fmt.Fprintln(w, line)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func writeListingHTML(w io.Writer, programs []program, indent bool) {
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Listing</title>\n")
+	fmt.Fprintf(w, "<style>%s</style>\n</head>\n<body>\n", reportStyle)
+	for pi, p := range programs {
+		if len(p.lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "<h2>Program %d &ldquo;%s&rdquo;</h2>\n", pi+1, reportText(p.name))
+		titles, sections := programListing(p, indent)
+		for i, title := range titles {
+			fmt.Fprintf(w, "<h3>%s</h3>\n<div class=\"basic\">", html.EscapeString(title))
+			for _, line := range sections[i] {
+				fmt.Fprintf(w, "%s\n", reportLine(line))
+			}
+			fmt.Fprintf(w, "</div>\n")
+		}
+	}
+	fmt.Fprintf(w, "</body>\n</html>\n")
+}
+
+// exportListing writes an indented listing and cross reference of every
+// program next to the project file.
+func exportListing() {
+	fileName := strings.TrimSuffix(projectFile, projectExt) + ".lst"
+	if err := writeListing(fileName, programs, true); err != nil {
+		setStatusMessage(err.Error())
+	} else {
+		setStatusMessage("Wrote listing " + fileName)
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"sort"
+	"strings"
+)
+
+const (
+	noteByte  = "byte"
+	noteLine  = "line"
+	noteAudio = "audio"
+)
+
+// A note is attached to a range of bytes, a basic line or a range of samples
+// in one of the programs. A byte note with no text is a bookmark. Every kind
+// is kept as the samples it covers, so it stays on the same stretch of tape
+// when the tape is decoded again and the bytes and lines move.
+type note struct {
+	Program int    `json:"program"` // worked out again after each decode
+	Kind    string `json:"kind"`
+	First   int    `json:"first"`
+	Last    int    `json:"last"`
+	Text    string `json:"text,omitempty"`
+}
+
+// byteSamples returns the first and last samples of a range of bytes.
+func byteSamples(p program, firstByte, lastByte int) (first, last int) {
+	first, _ = bytePlace(p, firstByte)
+	_, last = bytePlace(p, lastByte)
+	return
+}
+
+// byteRange returns the first and last bytes of the program the note covers:
+// those whose middles are in its samples, or the one under its middle.
+func (n note) byteRange(p program) (first, last int) {
+	if l := n.line(p); l >= 0 {
+		return p.lines[l].firstByte, p.lines[l].lastByte
+	}
+	middle := func(i int) int {
+		first, last := bytePlace(p, i)
+		return (first + last) / 2
+	}
+	first = sort.Search(len(p.bytes), func(i int) bool { return middle(i) >= n.First })
+	last = sort.Search(len(p.bytes), func(i int) bool { return middle(i) > n.Last }) - 1
+	if first > last {
+		first = sort.Search(len(p.bytes), func(i int) bool {
+			_, last := bytePlace(p, i)
+			return last >= (n.First+n.Last)/2
+		})
+		last = first
+		if first == len(p.bytes) {
+			return 0, -1
+		}
+	}
+	return
+}
+
+// line returns the index of the basic line a line note is on, or -1.
+func (n note) line(p program) int {
+	if n.Kind != noteLine || len(p.bytes) == 0 {
+		return -1
+	}
+	l := sort.Search(len(p.lines), func(i int) bool {
+		_, last := bytePlace(p, min(len(p.bytes)-1, p.lines[i].lastByte))
+		return last >= (n.First+n.Last)/2
+	})
+	if l == len(p.lines) {
+		return -1
+	}
+	return l
+}
+
+// describe says where in a program the note is, and what it says.
+func (n note) describe(p program) string {
+	var where string
+	first, last := n.byteRange(p)
+	switch {
+	case n.Kind == noteLine:
+		where = fmt.Sprintf("line #%d", n.line(p)+1)
+	case n.Kind == noteAudio:
+		where = fmt.Sprintf("%.3fs-%.3fs", float64(n.First)/44100, float64(n.Last)/44100)
+	case first == last:
+		where = fmt.Sprintf("byte %d", first)
+	default:
+		where = fmt.Sprintf("bytes %d-%d", first, last)
+	}
+	if n.Text == "" {
+		return where + " (bookmark)"
+	}
+	return where + ": " + n.Text
+}
+
+// placeNotes puts each note on the program whose bytes are nearest the
+// samples it covers, after the tape has been decoded.
+func placeNotes(programs []program) {
+	if proj == nil {
+		return
+	}
+	for i, n := range proj.Notes {
+		best, bestDist := n.Program, -1
+		for pi, p := range programs {
+			if len(p.bytes) == 0 {
+				continue
+			}
+			first, last := byteSamples(p, 0, len(p.bytes)-1)
+			if dist := max(0, max(first-n.Last, n.First-last)); bestDist < 0 || dist < bestDist {
+				best, bestDist = pi, dist
+			}
+		}
+		proj.Notes[i].Program = best
+	}
+}
+
+// programNotes returns the indexes of the notes on a program, in the order
+// they appear in it.
+func programNotes(pi int, p program) (notes []int) {
+	if proj == nil {
+		return
+	}
+	for i, n := range proj.Notes {
+		if n.Program == pi {
+			notes = append(notes, i)
+		}
+	}
+	sort.SliceStable(notes, func(i, j int) bool {
+		a, _ := proj.Notes[notes[i]].byteRange(p)
+		b, _ := proj.Notes[notes[j]].byteRange(p)
+		return a < b
+	})
+	return
+}
+
+// notesOver returns the indexes of the notes on a program that cover any of
+// the given range of bytes.
+func notesOver(pi int, p program, firstByte, lastByte int) (notes []int) {
+	for _, i := range programNotes(pi, p) {
+		if f, l := proj.Notes[i].byteRange(p); f <= lastByte && l >= firstByte {
+			notes = append(notes, i)
+		}
+	}
+	return
+}
+
+// noteTexts returns the text of the given notes, leaving out bookmarks.
+func noteTexts(notes []int) (texts []string) {
+	for _, i := range notes {
+		if proj.Notes[i].Text != "" {
+			texts = append(texts, proj.Notes[i].Text)
+		}
+	}
+	return
+}
+
+func addNote(n note) {
+	proj.Notes = append(proj.Notes, n)
+	refreshNotes()
+}
+
+func deleteNotes(notes []int) {
+	sort.Sort(sort.Reverse(sort.IntSlice(notes)))
+	for _, i := range notes {
+		proj.Notes = append(proj.Notes[:i], proj.Notes[i+1:]...)
+	}
+	refreshNotes()
+}
+
+// newNote asks for the text of a note and attaches it to whatever the
+// focused pane is showing: the selected range or byte in the hex pane, the
+// current line in the basic pane, or the visible samples in the wav pane. In
+// the notes panel it edits the selected note instead.
+func newNote() {
+	if focus == paneNotes {
+		notes := programNotes(progIndex, prog)
+		if notesSel < len(notes) {
+			i := notes[notesSel]
+			startPrompt("Note", proj.Notes[i].Text, func(text string) {
+				proj.Notes[i].Text = text
+				refreshNotes()
+			})
+		}
+		return
+	}
+
+	n := note{Program: progIndex, Kind: noteByte}
+	n.First, n.Last = byteSamples(prog, hexCursor, hexCursor)
+	switch {
+	case focus == paneWav && hasAudio(prog):
+		n.Kind = noteAudio
+		n.First, n.Last = wavRange()
+	case focus == paneBasic && basicCursorLine >= 0 && basicCursorLine < len(prog.lines):
+		n.Kind = noteLine
+		n.First, n.Last = byteSamples(prog, prog.lines[basicCursorLine].firstByte, prog.lines[basicCursorLine].lastByte)
+	case hexRangeStart >= 0:
+		n.First, n.Last = byteSamples(prog, hexRangeStart, hexRangeEnd)
+	}
+	startPrompt("Note on "+strings.SplitN(n.describe(prog), " (", 2)[0], "", func(text string) {
+		if text != "" {
+			n.Text = text
+			addNote(n)
+		}
+	})
+}
+
+// deleteNote deletes the selected note in the notes panel, or otherwise all
+// the notes over the cursor.
+func deleteNote() {
+	var notes []int
+	if focus == paneNotes {
+		if all := programNotes(progIndex, prog); notesSel < len(all) {
+			notes = []int{all[notesSel]}
+		}
+	} else {
+		notes = notesOver(progIndex, prog, hexCursor, hexCursor)
+	}
+	if len(notes) == 0 {
+		setStatusMessage("No notes here")
+		return
+	}
+	deleteNotes(notes)
+	setStatusMessage(fmt.Sprintf("Deleted %d notes", len(notes)))
+}
+
+// toggleBookmark sets or clears a bookmark on the byte under the cursor.
+func toggleBookmark() {
+	for i, n := range proj.Notes {
+		if f, l := n.byteRange(prog); n.Program == progIndex && n.Kind == noteByte && f == hexCursor && l == hexCursor && n.Text == "" {
+			deleteNotes([]int{i})
+			return
+		}
+	}
+	first, last := byteSamples(prog, hexCursor, hexCursor)
+	addNote(note{Program: progIndex, Kind: noteByte, First: first, Last: last})
+}
+
+// nextNote moves to the next (dir > 0) or previous (dir < 0) note or
+// bookmark in the current program.
+func nextNote(dir int) {
+	notes := programNotes(progIndex, prog)
+	if dir < 0 {
+		for i, j := 0, len(notes)-1; i < j; i, j = i+1, j-1 {
+			notes[i], notes[j] = notes[j], notes[i]
+		}
+	}
+	for _, i := range notes {
+		if b, _ := proj.Notes[i].byteRange(prog); (dir > 0 && b > hexCursor) || (dir < 0 && b < hexCursor) {
+			moveHexCursor(b)
+			return
+		}
+	}
+	setStatusMessage("No more notes")
+}
+
+var notesVisible bool
+var notesWidth int
+var notesSel, notesTop int
+
+func toggleNotes() {
+	notesVisible = !notesVisible
+	if !notesVisible && focus == paneNotes {
+		focus = paneHex
+	}
+	w, h := termbox.Size()
+	resetSize(w, h)
+	hexStart = max(0, (hexCursor/hexCols-1)*hexCols)
+	redrawAll()
+}
+
+// refreshNotes redraws everything that shows notes after they change.
+func refreshNotes() {
+	redrawSelection(false)
+	redrawHex()
+	redrawBasic()
+	redrawWav()
+	redrawNotes()
+	redrawSelection(true)
+	updateNoteStatus()
+	redrawHeaders()
+	termbox.Flush()
+}
+
+var hexNoteStatus, basicNoteStatus string
+
+func updateNoteStatus() {
+	hexNoteStatus = strings.Join(noteTexts(notesOver(progIndex, prog, hexCursor, hexCursor)), "; ")
+	basicNoteStatus = ""
+	if basicCursorLine >= 0 && basicCursorLine < len(prog.lines) {
+		var lineNotes []int
+		for _, i := range programNotes(progIndex, prog) {
+			if proj.Notes[i].line(prog) == basicCursorLine {
+				lineNotes = append(lineNotes, i)
+			}
+		}
+		basicNoteStatus = strings.Join(noteTexts(lineNotes), "; ")
+	}
+}
+
+// redrawNotes draws the list of notes on the current program down the right
+// hand side of the hex and basic panes.
+func redrawNotes() {
+	if !notesVisible {
+		return
+	}
+	x0 := paneWidth
+	notes := programNotes(progIndex, prog)
+	notesSel = max(0, min(len(notes)-1, notesSel))
+
+	lineCol := termbox.ColorBlue
+	if focus == paneNotes {
+		lineCol = curCol
+	}
+	for x := x0; x < currentWidth; x++ {
+		termbox.SetCell(x, hexHeaderY, horizontalLine, lineCol, bgCol)
+	}
+	termbox.SetCell(x0, hexHeaderY, '┬', lineCol, bgCol)
+	tbPrint(x0+1, hexHeaderY, fgCol, bgCol, fmt.Sprintf("Notes (%d)", len(notes)))
+
+	rows := statusY - hexHeaderY - 1
+	if notesSel < notesTop {
+		notesTop = notesSel
+	} else if notesSel >= notesTop+rows {
+		notesTop = notesSel - rows + 1
+	}
+	for row := 0; row < rows; row++ {
+		y := hexHeaderY + 1 + row
+		termbox.SetCell(x0, y, '│', lineCol, bgCol)
+		text := ""
+		fg, bg := fgCol, bgCol
+		if i := notesTop + row; i < len(notes) {
+			n := proj.Notes[notes[i]]
+			text = n.describe(prog)
+			if f, l := n.byteRange(prog); hexCursor >= f && hexCursor <= l {
+				fg = termbox.ColorMagenta
+			}
+			if i == notesSel && focus == paneNotes {
+				bg = selCol
+			}
+		}
+		r := []rune(text)
+		for x := 1; x < notesWidth; x++ {
+			c := ' '
+			if x-1 < len(r) {
+				c = r[x-1]
+			}
+			termbox.SetCell(x0+x, y, c, fg, bg)
+		}
+	}
+}
+
+// moveNotes moves the selection in the notes panel, taking the cursor to the
+// selected note.
+func moveNotes(m motion) {
+	notes := programNotes(progIndex, prog)
+	rows := statusY - hexHeaderY - 1
+	switch m {
+	case motionUp, motionLeft:
+		notesSel--
+	case motionDown, motionRight:
+		notesSel++
+	case motionPageUp:
+		notesSel = notesSel - rows
+	case motionPageDown:
+		notesSel = notesSel + rows
+	case motionHome:
+		notesSel = 0
+	case motionEnd:
+		notesSel = len(notes) - 1
+	}
+	selectNote(notesSel)
+}
+
+func selectNote(sel int) {
+	notes := programNotes(progIndex, prog)
+	if len(notes) == 0 {
+		return
+	}
+	notesSel = max(0, min(len(notes)-1, sel))
+	b, _ := proj.Notes[notes[notesSel]].byteRange(prog)
+	moveHexCursor(max(0, min(len(prog.bytes)-1, b)))
+}
+
+// noteMarks returns which of the given range of bytes have notes over them.
+func noteMarks(pi int, p program, firstByte, lastByte int) []bool {
+	marks := make([]bool, max(0, lastByte-firstByte+1))
+	for _, i := range notesOver(pi, p, firstByte, lastByte) {
+		f, l := proj.Notes[i].byteRange(p)
+		for b := max(f, firstByte); b <= min(l, lastByte); b++ {
+			marks[b-firstByte] = true
+		}
+	}
+	return marks
+}
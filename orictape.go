@@ -13,9 +13,13 @@
 // limitations under the License in the main package.
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"sort"
+	"strings"
 )
 
 type bit byte
@@ -24,12 +28,40 @@ type bitInfo struct {
 	l1, l2                  int
 	firstSample, lastSample int
 	unclear                 bool
+	confidence              float64 // 0 when the demodulator doesn't measure it
+	dropout                 bool    // stands for a gap in the signal, not a bit
+	clipped                 bool    // some of its samples are at the limits
 }
 
 type byteInfo struct {
-	v                 byte
-	firstBit, lastBit int
-	unclear, chkErr   bool
+	v                        byte
+	firstBit, lastBit        int
+	unclear, chkErr, missing bool
+	fixed                    bool // set by the user
+}
+
+type bitRole int
+
+const (
+	roleNone bitRole = iota
+	roleStop
+	roleStart
+	roleData
+	roleParity
+)
+
+func (r bitRole) String(pos int) string {
+	switch r {
+	case roleStop:
+		return "stop"
+	case roleStart:
+		return "start"
+	case roleData:
+		return fmt.Sprintf("%d", pos)
+	case roleParity:
+		return "parity"
+	}
+	return "-"
 }
 
 type lineInfo struct {
@@ -38,6 +70,7 @@ type lineInfo struct {
 	firstByte, lastByte int
 	expectedLastByte    int
 	lenErr              bool
+	suspect             []string // what checkBasic found wrong with it
 }
 
 type bitStream struct {
@@ -45,6 +78,30 @@ type bitStream struct {
 	samples                 []int16
 	firstSample, lastSample int
 	minVal, maxVal          int16
+	demod                   string
+	fragment                fragmentReason
+	quality                 captureQuality
+}
+
+// A fragmentReason says why a run of signal is only a fragment of a stream.
+// Fragments are kept, as they may be a separate header or a piece of a
+// damaged program.
+type fragmentReason int
+
+const (
+	fragmentNone  fragmentReason = iota
+	fragmentShort                // ended by a gap before the minimum length
+	fragmentCut                  // ended by the end of the recording
+)
+
+func (r fragmentReason) String() string {
+	switch r {
+	case fragmentShort:
+		return "short"
+	case fragmentCut:
+		return "cut off"
+	}
+	return ""
 }
 
 type program struct {
@@ -52,14 +109,75 @@ type program struct {
 	bytes  []byteInfo
 	lines  []lineInfo
 	name   string
+	header *tapeHeader // nil if no header was found
+	// The bytes the user has fixed, as they were read.
+	unfixed map[int]byteInfo
+	offset  int // of the first byte in the .tap file it was read from
+}
+
+// hasAudio says whether a program was read from a recording, rather than
+// from a .tap file with no audio behind its bytes.
+func hasAudio(p program) bool {
+	return len(p.stream.bits) > 0
+}
+
+// bytePlace returns where a byte is on the tape: the first and last samples
+// of its bits, or its offset in the .tap file it was read from.
+func bytePlace(p program, i int) (first, last int) {
+	if !hasAudio(p) {
+		return p.offset + i, p.offset + i
+	}
+	bits := p.stream.bits
+	return bits[p.bytes[i].firstBit].firstSample, bits[p.bytes[i].lastBit].lastSample
+}
+
+// A tapeHeader is what the header before the name says about a file.
+type tapeHeader struct {
+	basic      bool
+	autorun    bool
+	start, end int // addresses the file loads to
+	dataStart  int // index of the first byte after the name
 }
 
 const (
 	ShortThreshold    int = 20
 	LongThreshold     int = 24
 	NoSignalThreshold int = 46
+	MinStreamBits     int = 8820
+	MaxDropout        int = 50 // milliseconds
 )
 
+// decoderSettings holds the cycle lengths, in samples, used to decide bits,
+// how silence is told from signal, the fewest bits a run of signal needs to be
+// a whole stream, the longest gap in milliseconds to bridge as a dropout,
+// which demodulator reads the bits of each stream, how bits are framed into
+// bytes, and whether to sweep variations of them for the best decode.
+type decoderSettings struct {
+	ShortThreshold     int            `json:"shortThreshold"`
+	LongThreshold      int            `json:"longThreshold"`
+	NoSignalThreshold  int            `json:"noSignalThreshold"`
+	MinStreamBits      int            `json:"minStreamBits,omitempty"`
+	MaxDropout         int            `json:"maxDropout"`
+	Silence            string         `json:"silence,omitempty"`
+	Demodulator        string         `json:"demodulator,omitempty"`
+	StreamDemodulators map[int]string `json:"streamDemodulators,omitempty"` // by a sample inside the stream
+	Framing            string         `json:"framing,omitempty"`
+	Sweep              bool           `json:"sweep,omitempty"`
+}
+
+var defaultSettings = decoderSettings{ShortThreshold: ShortThreshold, LongThreshold: LongThreshold,
+	NoSignalThreshold: NoSignalThreshold, MinStreamBits: MinStreamBits,
+	MaxDropout: MaxDropout}
+
+// minStreamBits returns the fewest bits a run of signal needs to be a whole
+// stream, allowing for projects saved before it could be set.
+func (s decoderSettings) minStreamBits() int {
+	if s.MinStreamBits <= 0 {
+		return MinStreamBits
+	}
+	return s.MinStreamBits
+}
+
 const CLR_0 = "\x1b[30;1m"
 const CLR_R = "\x1b[31;1m"
 const CLR_G = "\x1b[32;1m"
@@ -83,37 +201,202 @@ var keywords []string = []string{"END", "EDIT", "STORE", "RECALL", "TRON", "TROF
 	"TRUE", "FALSE", "KEY$", "SCRN", "POINT", "LEFT$", "RIGHT$", "MID$"}
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: orictape <input wav file>")
+	channel := flag.String("channel", "left", "audio `channel` to decode (left or right)")
+	invert := flag.Bool("invert", false, "invert the polarity of the audio")
+	filter := flag.String("filter", "", "`filter` to apply to the audio (smooth)")
+	short := flag.Int("short", ShortThreshold, "longest cycle, in samples, that is clearly a 1")
+	long := flag.Int("long", LongThreshold, "shortest cycle, in samples, that is clearly a 0")
+	noSignal := flag.Int("nosignal", NoSignalThreshold, "shortest cycle, in samples, that counts as no signal")
+	dropout := flag.Int("dropout", MaxDropout, "longest gap, in milliseconds, to bridge as a dropout within a stream (0 for none)")
+	silence := flag.String("silence", "energy", "how to find the silence between streams ("+strings.Join(silenceNames, ", ")+")")
+	minBits := flag.Int("minbits", MinStreamBits, "fewest bits in a whole stream; shorter runs are kept as fragments")
+	projectFlag := flag.String("project", "", "project `file` to save the session to")
+	flag.StringVar(&corpusDir, "corpus", "", "`folder` of known good Basic listings to suggest damaged bytes from (default ~/.orictape-corpus)")
+	demod := flag.String("demod", "peak", "`demodulator` to read bits with ("+strings.Join(demodulatorNames, ", ")+")")
+	framing := flag.String("framing", "simple", "how to frame bits into bytes ("+strings.Join(framingNames, ", ")+")")
+	sweepFlag := flag.Bool("sweep", false, "try variations of the settings in parallel and keep the best decode of each program")
+	histFlag := flag.Bool("histogram", false, "print cycle length histograms instead of opening the UI")
+	reportFlag := flag.String("report", "", "write an html report to `file` instead of opening the UI")
+	traceFlag := flag.String("trace", "", "write a record of every cycle to `file` (.csv, or else JSON lines) instead of opening the UI")
+	traceRange := flag.String("range", "", "`first:last` samples to trace (either may be left out)")
+	listingFlag := flag.String("listing", "", "write a listing and cross reference to `file` (.html, or else text) instead of opening the UI")
+	indentFlag := flag.Bool("indent", false, "space out and indent the listing")
+	imagesFlag := flag.String("images", "", "write the screens and character sets on the tape as PNG files to `folder` instead of opening the UI")
+	flag.Usage = func() {
+		fmt.Println("Usage: orictape [options] <input wav or tap file>")
+		fmt.Println("       orictape <project file>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
 		return
 	}
 
-	left, _, err := readWavFile(os.Args[1])
+	var err error
+	if strings.HasSuffix(flag.Arg(0), projectExt) {
+		projectFile = flag.Arg(0)
+		proj, err = loadProject(projectFile)
+	} else {
+		projectFile = *projectFlag
+		if projectFile == "" {
+			projectFile = strings.TrimSuffix(strings.TrimSuffix(flag.Arg(0), ".wav"), tapExt) + projectExt
+		}
+		if _, err = os.Stat(projectFile); err == nil {
+			// Pick up the session saved for this recording rather than
+			// starting a new one that would be saved over it.
+			proj, err = reopenProject(projectFile, flag.Arg(0))
+			var ignored []string
+			flag.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "channel", "invert", "filter", "short", "long", "nosignal", "dropout", "silence", "minbits",
+					"demod", "framing", "sweep":
+					ignored = append(ignored, "-"+f.Name)
+				}
+			})
+			if err == nil {
+				fmt.Printf("Opened %s\n", projectFile)
+				if len(ignored) > 0 {
+					fmt.Printf("Using the settings saved in it, not %s\n", strings.Join(ignored, " "))
+				}
+			}
+		} else {
+			proj, err = newProject(flag.Arg(0), *channel, *invert, *filter, decoderSettings{ShortThreshold: *short,
+				LongThreshold: *long, NoSignalThreshold: *noSignal, MinStreamBits: *minBits, MaxDropout: *dropout, Silence: *silence, Demodulator: *demod, Framing: *framing,
+				Sweep: *sweepFlag})
+		}
+	}
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	streams := readBitStreams(left)
-	fmt.Printf("Read %d streams\n", len(streams))
+	var streams []bitStream
+	var programs []program
+	if src := proj.Sources[0]; isTapFile(src.Path) {
+		// The bytes are in the file, so there is no signal to decode
+		// or sweep.
+		if err = checkSource(src); err == nil {
+			programs, tapeLength, err = readTapFile(src.Path, os.Stdout)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		applyFixes(programs)
+		placeNotes(programs)
+		fmt.Printf("Read %d programs\n", len(programs))
+	} else if proj.Settings.Sweep {
+		// The sweep decodes the tape with every candidate, the current
+		// settings among them, so it isn't decoded with those first.
+		var swept sweepResult
+		if err = checkSource(src); err == nil {
+			swept, err = sweepFromCommandLine()
+		}
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		keepSweep(swept)
+		streams, programs = swept.streams, swept.programs()
+		applyFixes(programs)
+		placeNotes(programs)
+		fmt.Printf("Read %d streams\n", len(streams))
+		fmt.Printf("Read %d programs\n", len(programs))
+	} else {
+		samples, err := readSource(src, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		tapeSamples, tapeLength = samples, len(samples)
 
-	programs := readPrograms(streams)
-	fmt.Printf("Read %d programs\n", len(programs))
+		streams = readBitStreams(samples, proj.Settings, os.Stdout)
+		fmt.Printf("Read %d streams\n", len(streams))
 
-	for _, prog := range programs {
+		programs = readPrograms(streams, proj.Settings, os.Stdout)
+		applyFixes(programs)
+		placeNotes(programs)
+		fmt.Printf("Read %d programs\n", len(programs))
+	}
+
+	for pi, prog := range programs {
 		fmt.Printf("[%s]\n", prog.name)
+		if prog.header != nil && !prog.header.basic {
+			fmt.Printf("    %s\n", blockDescription(prog))
+		}
 		for _, line := range prog.lines {
 			if line.lenErr {
 				fmt.Printf("%d %d %s%s%s\n", line.expectedLastByte-line.lastByte, line.lastByte-line.firstByte+1, CLR_R, line.v, CLR_0)
 			} else {
 				fmt.Println(line.v)
 			}
+			for _, text := range line.suspect {
+				fmt.Printf("    %s! %s%s\n", CLR_Y, text, CLR_0)
+			}
+			for _, text := range noteTexts(notesOver(pi, prog, line.firstByte, line.lastByte)) {
+				fmt.Printf("    %s; %s%s\n", CLR_M, text, CLR_0)
+			}
 		}
 	}
 
 	fmt.Println("\n**done**")
 
-	displayUI(programs[0])
+	if *histFlag {
+		printHistograms(streams, proj.Settings)
+		return
+	}
+	if *reportFlag != "" {
+		if err = writeReport(*reportFlag, streams, programs); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Printf("Wrote report %s\n", *reportFlag)
+		}
+		return
+	}
+	if *traceFlag != "" {
+		first, last, err := parseSampleRange(*traceRange)
+		if err == nil {
+			var n int
+			if n, err = writeTrace(*traceFlag, streams, programs, proj.Settings, first, last); err == nil {
+				fmt.Printf("Wrote %d cycles to %s\n", n, *traceFlag)
+			}
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+	if *imagesFlag != "" {
+		names, err := writeImages(*imagesFlag, programs)
+		for _, name := range names {
+			fmt.Printf("Wrote %s\n", name)
+		}
+		if err != nil {
+			fmt.Println(err)
+		} else if len(names) == 0 {
+			fmt.Println("No screens or character sets found")
+		}
+		return
+	}
+	if *listingFlag != "" {
+		if err = writeListing(*listingFlag, programs, *indentFlag); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Printf("Wrote listing %s\n", *listingFlag)
+		}
+		return
+	}
+
+	if len(programs) == 0 {
+		fmt.Printf("%s**** no programs found ****%s\n", CLR_R, CLR_0)
+		return
+	}
+	if err = loadKeyConfig(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	displayUI(streams, programs)
 }
 
 func min(a, b int) int {
@@ -156,27 +439,129 @@ func abs(i int) int {
 	}
 }
 
-func readBitStreams(samples []int16) (streams []bitStream) {
-	startSample := 0
-	for stream, samplesRead := readBitStream(samples, startSample); samplesRead > 0; stream, samplesRead = readBitStream(samples, startSample) {
-		streams = append(streams, stream)
-		startSample += samplesRead
+// readBitStreams finds the streams on the tape and reads their bits,
+// reporting what it finds to log.
+func readBitStreams(samples []int16, settings decoderSettings, log io.Writer) (streams []bitStream) {
+	// Only look for cycles where there is signal, unless told to go by the
+	// cycle lengths alone.
+	regions := []signalRegion{{0, len(samples) - 1}}
+	if settings.Silence != "cycles" {
+		var floor, level float64
+		regions, floor, level = findSignal(samples)
+		fmt.Fprintf(log, "Found %d regions of signal (noise floor %.0f, signal %.0f rms)\n", len(regions), floor, level)
+	}
+
+	var runs []bitStream
+	for _, r := range regions {
+		region := samples[:r.last+1]
+		startSample := r.first
+		for stream, samplesRead := readBitStream(region, startSample, settings); samplesRead > 0; stream, samplesRead = readBitStream(region, startSample, settings) {
+			if len(stream.bits) > 0 {
+				stream.samples = samples
+				if stream.fragment == fragmentCut && r.last < len(samples)-1 {
+					stream.fragment = fragmentShort
+				}
+				runs = append(runs, stream)
+			}
+			startSample += samplesRead
+		}
 	}
 
-	fmt.Printf("Found %d streams:\n", len(streams))
+	// Runs of signal with only a dropout between them are one stream, once
+	// a program has started in it and unless the next run starts another.
+	synced := make([]bool, len(runs))
+	leader := make([]bool, len(runs))
+	parallel(len(runs), func(i int) {
+		synced[i], leader[i] = programStart(runs[i])
+	})
+	group := make([]int, len(runs))
+	var groupFirst, groupLast []int
+	groupSynced := false
+	for i := range runs {
+		if i > 0 {
+			group[i] = group[i-1]
+			if !groupSynced || leader[i] || !isDropout(runs[i-1], runs[i], settings) {
+				group[i]++
+				groupSynced = false
+			}
+		}
+		if group[i] == len(groupFirst) {
+			groupFirst = append(groupFirst, runs[i].firstSample)
+			groupLast = append(groupLast, 0)
+		}
+		groupLast[group[i]] = runs[i].lastSample
+		groupSynced = groupSynced || synced[i]
+	}
+
+	// The peak search also splits the tape into runs, so its bits are
+	// already there. Any other demodulator reads each run again.
+	parallel(len(runs), func(i int) {
+		runs[i].demod = settings.demodulatorFor(groupFirst[group[i]], groupLast[group[i]])
+		if runs[i].demod != "peak" {
+			runs[i].bits = demodulators[runs[i].demod].demodulate(runs[i], settings)
+		}
+	})
+	lastGroup := -1
+	for i, run := range runs {
+		if len(run.bits) == 0 {
+			// The demodulator found no bits in it.
+			continue
+		}
+		if group[i] == lastGroup {
+			streams[len(streams)-1] = bridgeDropout(streams[len(streams)-1], run, settings)
+		} else {
+			streams = append(streams, run)
+		}
+		lastGroup = group[i]
+	}
+
+	parallel(len(streams), func(i int) {
+		measureQuality(&streams[i])
+	})
+
+	fmt.Fprintf(log, "Found %d streams:\n", len(streams))
 	for i, stream := range streams {
-		fmt.Printf(" %d) Starting at %ds found stream of length %ds (%d bits)\n", i, stream.firstSample/44100, (stream.lastSample-stream.firstSample)/44100, len(stream.bits))
+		kind := "stream"
+		if stream.fragment != fragmentNone {
+			kind = fmt.Sprintf("%s fragment", stream.fragment)
+		}
+		fmt.Fprintf(log, " %d) Starting at %.1fs found %s of length %.1fs (%d bits, %s)\n", i, float64(stream.firstSample)/44100, kind, float64(stream.lastSample-stream.firstSample)/44100, len(stream.bits), stream.demod)
 	}
+	printCaptureQuality(log, streams)
 	return
 }
 
-func readBitStream(samples []int16, startSample int) (stream bitStream, samplesRead int) {
-	var minVal, maxVal, threshold int16
+// A cycleTrace records how readCycle found one cycle: the min and max it
+// found, the thresholds half way to them and where the signal crossed them.
+type cycleTrace struct {
+	minIndex, maxIndex     int
+	minVal, maxVal         int16
+	fallThreshold          int16 // between the last max and this min
+	riseThreshold          int16 // between this min and the next max
+	belowIndex, aboveIndex int
+	l1, l2                 int
+	noSignal               bool
+}
+
+func readBitStream(samples []int16, startSample int, settings decoderSettings) (stream bitStream, samplesRead int) {
+	return traceBitStream(samples, startSample, settings, nil)
+}
+
+// traceBitStream is readBitStream, passing each cycle it finds to trace if
+// it isn't nil.
+func traceBitStream(samples []int16, startSample int, settings decoderSettings, trace func(cycleTrace)) (stream bitStream, samplesRead int) {
+	var minVal, maxVal, threshold, fallThreshold int16
 	var minIndex, maxIndex, belowIndex, aboveIndex, searchWindowIndex int
 	var searchWindow []int16
-	var lengthBelow, lengthAbove, length int
+	var lengthBelow, lengthAbove int
 
 	readCycle := func() (noSignal bool) {
+		// Stop at the end of the samples, where there isn't room to search.
+		if maxIndex+2 >= len(samples) {
+			maxIndex = len(samples)
+			return true
+		}
+
 		// Search for the next min.
 		minVal = math.MaxInt16
 		searchWindow = samples[maxIndex+1 : min(maxIndex+20, len(samples))]
@@ -191,6 +576,7 @@ func readBitStream(samples []int16, startSample int) (stream bitStream, samplesR
 
 		// Now find the cross over point where we fall below the threshold.
 		threshold = (maxVal + minVal) / 2
+		fallThreshold = threshold
 		for i, v := range searchWindow {
 			if v <= threshold {
 				searchWindowIndex = i
@@ -200,6 +586,11 @@ func readBitStream(samples []int16, startSample int) (stream bitStream, samplesR
 		belowIndex = maxIndex + 1 + searchWindowIndex
 		lengthBelow = belowIndex - aboveIndex
 
+		if minIndex+2 >= len(samples) {
+			maxIndex = len(samples)
+			return true
+		}
+
 		// Search for the next max.
 		maxVal = math.MinInt16
 		searchWindow = samples[minIndex+1 : min(minIndex+20, len(samples))]
@@ -222,35 +613,24 @@ func readBitStream(samples []int16, startSample int) (stream bitStream, samplesR
 		}
 		aboveIndex = minIndex + 1 + searchWindowIndex
 		lengthAbove = aboveIndex - belowIndex
-		length = lengthBelow + lengthAbove
 
-		switch {
-		case length > NoSignalThreshold:
-			noSignal = true
-		case length >= LongThreshold:
-			stream.bits = append(stream.bits, bitInfo{v: 0, l1: lengthBelow, l2: lengthAbove,
-				firstSample: aboveIndex - length, lastSample: aboveIndex - 1})
-		case length <= ShortThreshold:
-			stream.bits = append(stream.bits, bitInfo{v: 1, l1: lengthBelow, l2: lengthAbove,
-				firstSample: aboveIndex - length, lastSample: aboveIndex - 1})
-		case abs(lengthBelow-lengthAbove) <= (LongThreshold-ShortThreshold)/2:
-			// Unclear long
-			stream.bits = append(stream.bits, bitInfo{v: 0, l1: lengthBelow, l2: lengthAbove, unclear: true,
-				firstSample: aboveIndex - length, lastSample: aboveIndex - 1})
-		default:
-			// Unclear short
-			stream.bits = append(stream.bits, bitInfo{v: 1, l1: lengthBelow, l2: lengthAbove, unclear: true,
-				firstSample: aboveIndex - length, lastSample: aboveIndex - 1})
+		var bi bitInfo
+		if bi, noSignal = decideBit(lengthBelow, lengthAbove, aboveIndex-1, settings); !noSignal {
+			stream.bits = append(stream.bits, bi)
+		}
+		if trace != nil {
+			trace(cycleTrace{minIndex, maxIndex, minVal, maxVal, fallThreshold, threshold,
+				belowIndex, aboveIndex, lengthBelow, lengthAbove, noSignal})
 		}
 		return noSignal
 	}
 
 	stream.samples = samples
-	// Search for a stream until we find one at least 0.2 seconds long.
+	stream.minVal, stream.maxVal = math.MaxInt16, math.MinInt16
+	// Skip any silence, then read the run of signal after it.
 	maxIndex = startSample
 	aboveIndex = startSample
-	for maxIndex < len(samples) && len(stream.bits) < 8820 {
-		stream.bits = nil
+	for maxIndex < len(samples) && len(stream.bits) == 0 {
 		stream.firstSample = aboveIndex
 
 		// Read stream until we hit no signal.
@@ -262,35 +642,68 @@ func readBitStream(samples []int16, startSample int) (stream bitStream, samplesR
 	}
 	samplesRead = aboveIndex - startSample
 	stream.lastSample = aboveIndex
+	if len(stream.bits) < settings.minStreamBits() {
+		stream.fragment = fragmentShort
+		if maxIndex >= len(samples) {
+			stream.fragment = fragmentCut
+		}
+	}
 	return
 }
 
-func readPrograms(streams []bitStream) (programs []program) {
-	for _, stream := range streams {
-		prog := readProgramBytes(stream)
+// decideBit decides which bit a cycle is from the lengths of its high (l1)
+// and low (l2) halves, or that it is too long to be a bit at all.
+func decideBit(l1, l2, lastSample int, settings decoderSettings) (bi bitInfo, noSignal bool) {
+	length := l1 + l2
+	bi = bitInfo{l1: l1, l2: l2, firstSample: lastSample - length + 1, lastSample: lastSample}
+	switch {
+	case length > settings.NoSignalThreshold:
+		noSignal = true
+	case length >= settings.LongThreshold:
+		bi.v = 0
+	case length <= settings.ShortThreshold:
+		bi.v = 1
+	case abs(l1-l2) <= (settings.LongThreshold-settings.ShortThreshold)/2:
+		// Unclear long
+		bi.v, bi.unclear = 0, true
+	default:
+		// Unclear short
+		bi.v, bi.unclear = 1, true
+	}
+	return
+}
+
+func readPrograms(streams []bitStream, settings decoderSettings, log io.Writer) (programs []program) {
+	progs := make([]program, len(streams))
+	parallel(len(streams), func(i int) {
+		progs[i] = readStreamBytes(streams[i], settings)
+	})
+	for _, prog := range progs {
 		if len(prog.bytes) > 0 {
-			readProgramLines(&prog)
+			readProgramLines(&prog, log)
 
 			programs = append(programs, prog)
 
-			fmt.Println("Program:")
+			fmt.Fprintln(log, "Program:")
 			for _, bti := range prog.bytes {
 				switch {
+				case bti.missing:
+					fmt.Fprintf(log, " %s??%s", CLR_M, CLR_0)
 				case bti.chkErr:
-					fmt.Printf(" %s%02x%s", CLR_R, bti.v, CLR_0)
+					fmt.Fprintf(log, " %s%02x%s", CLR_R, bti.v, CLR_0)
 				case bti.unclear:
-					fmt.Printf(" %s%02x%s", CLR_Y, bti.v, CLR_0)
+					fmt.Fprintf(log, " %s%02x%s", CLR_Y, bti.v, CLR_0)
 				default:
-					fmt.Printf(" %02x", bti.v)
+					fmt.Fprintf(log, " %02x", bti.v)
 				}
 			}
-			fmt.Println("")
+			fmt.Fprintln(log, "")
 		}
 	}
 	return
 }
 
-func readProgramLines(prog *program) {
+func readProgramLines(prog *program, log io.Writer) {
 	var nextByte int
 	var lineStart int
 	var b byte
@@ -318,30 +731,34 @@ findSync:
 			return
 		case b == 0x16:
 			syncCount++
-		case b == 0x24 && syncCount > 3:
+		case b == 0x24 && (syncCount > 3 || !hasAudio(*prog) && syncCount > 0):
+			// A .tap file keeps only a few of the sync bytes.
 			break findSync
 		default:
 			syncCount = 0
 		}
 	}
-	fmt.Printf("\n%s**** synchronized ****%s\n", CLR_G, CLR_0)
+	fmt.Fprintf(log, "\n%s**** synchronized ****%s\n", CLR_G, CLR_0)
 
 	// Read the file header.
 	header := make([]byte, 9)
 	for i := 0; i < len(header); i++ {
 		header[i] = getByte()
 	}
-	if header[2] != 0 {
-		fmt.Printf("\n%s**** not a basic file ****%s\n", CLR_R, CLR_0)
-		return
-	}
+	prog.header = &tapeHeader{basic: header[2] == 0, autorun: header[3] != 0,
+		start: int(header[6])<<8 | int(header[7]), end: int(header[4])<<8 | int(header[5])}
 
 	// Strip the program name.
-	fmt.Printf("%sLoading ", CLR_G)
+	fmt.Fprintf(log, "%sLoading ", CLR_G)
 	for b = getByte(); b > 0; b = getByte() {
-		prog.name = prog.name + string(b)
+		prog.name = prog.name + string(oricRune(b))
+	}
+	fmt.Fprintf(log, "%s%s\n", prog.name, CLR_0)
+	prog.header.dataStart = nextByte
+	if !prog.header.basic {
+		fmt.Fprintf(log, "\n%s**** not a basic file: %s ****%s\n", CLR_R, blockDescription(*prog), CLR_0)
+		return
 	}
-	fmt.Printf("%s%s\n", prog.name, CLR_0)
 
 	// Read the program lines.
 	correctionOffset := 0
@@ -368,7 +785,7 @@ findSync:
 			case b == 0:
 				break readLine
 			case b < 128:
-				element = string(b)
+				element = string(oricRune(b))
 			case int(b-byte(128)) < len(keywords):
 				element = keywords[b-128]
 			default:
@@ -392,6 +809,7 @@ findSync:
 		prog.lines[0].lenErr = false
 		prog.lines[0].expectedLastByte = prog.lines[0].lastByte
 	}
+	checkBasic(prog)
 }
 
 func readProgramBytes(stream bitStream) (prog program) {
@@ -470,3 +888,23 @@ func readProgramBytes(stream bitStream) (prog program) {
 			unclear: byteUnclear, chkErr: bt == bit(chk&1)})
 	}
 }
+
+// bitRoleAt returns the role of the given bit within the byte frame it was
+// read as part of, and for data bits its position within the byte. Each
+// frame is one or more stop bits, a 0 start bit, 8 data bits (lsb first) and
+// a parity bit.
+func bitRoleAt(bytes []byteInfo, bitIndex int) (role bitRole, pos int) {
+	i := sort.Search(len(bytes), func(i int) bool { return bytes[i].lastBit >= bitIndex })
+	if i == len(bytes) || bitIndex < bytes[i].firstBit {
+		return roleNone, 0
+	}
+	switch pos = bitIndex - (bytes[i].lastBit - 9); {
+	case pos < 0:
+		return roleStop, 0
+	case pos == 0:
+		return roleStart, 0
+	case pos <= 8:
+		return roleData, pos - 1
+	}
+	return roleParity, 0
+}
@@ -0,0 +1,159 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"sort"
+)
+
+// The overlay is only drawn when zoomed in this far (samples per column), as
+// further out the marks would cover the wave.
+const overlayMaxSamples = 8
+
+var overlayVisible bool
+
+// The traced cycles of the current stream, and what they were traced from.
+var overlayTraces []cycleTrace
+var overlayKey struct {
+	first, last, bits, short, long, noSignal int
+}
+
+// traceCycles runs the peak search over a stream again, as its runs were
+// first read, and returns how it found each cycle, including any too long
+// to be a bit that ended a run.
+func traceCycles(stream bitStream, settings decoderSettings) (traces []cycleTrace) {
+	samples := stream.samples[:min(stream.lastSample+1, len(stream.samples))]
+	start := stream.firstSample
+	for {
+		_, samplesRead := traceBitStream(samples, start, settings, func(c cycleTrace) {
+			traces = append(traces, c)
+		})
+		if samplesRead <= 0 {
+			return
+		}
+		start += samplesRead
+	}
+}
+
+// currentTraces returns the traced cycles of the current stream, tracing
+// them again if the stream or the thresholds have changed.
+func currentTraces() []cycleTrace {
+	st, s := prog.stream, proj.Settings
+	key := overlayKey
+	key.first, key.last, key.bits = st.firstSample, st.lastSample, len(st.bits)
+	key.short, key.long, key.noSignal = s.ShortThreshold, s.LongThreshold, s.NoSignalThreshold
+	if key != overlayKey || overlayTraces == nil {
+		overlayTraces = traceCycles(st, s)
+		overlayKey = key
+	}
+	return overlayTraces
+}
+
+// overlayStatus says whether the overlay can be drawn, for the wave header.
+func overlayStatus() string {
+	first, last := wavRange()
+	switch {
+	case prog.stream.demod != "peak":
+		return "overlay for the peak demodulator only"
+	case (last-first+1)/(currentWidth-2) > overlayMaxSamples:
+		return "zoom in for the overlay"
+	}
+	return "overlay"
+}
+
+func toggleOverlay() {
+	if !needAudio("overlay") {
+		return
+	}
+	overlayVisible = !overlayVisible
+	if overlayVisible {
+		setStatusMessage("Showing the peaks, thresholds and crossings of the peak search")
+	} else {
+		setStatusMessage("Hid the demodulator overlay")
+	}
+	refreshWav()
+}
+
+// drawOverlay draws over the wave what the peak search found in each cycle:
+// the min and max it found (cyan), the thresholds half way between them
+// (magenta) and where the signal crossed them (blue). The scale is the one
+// the wave was drawn with.
+func drawOverlay(first, last, yOffset, yScale int) {
+	if overlayStatus() != "overlay" {
+		return
+	}
+	span := last - first + 1
+	cols := currentWidth - 2
+	rows := 4 * wavHeight
+	cells := termbox.CellBuffer()
+
+	// dot sets a braille dot, by dot column and row, keeping any dots
+	// already in the cell. The cell takes the colour given if it was empty,
+	// or if force is set.
+	subOf := func(sample int) int {
+		return (sample - first) * 2 * cols / span
+	}
+	dot := func(sub, y int, fg termbox.Attribute, force bool) {
+		if sub < 0 || sub >= 2*cols || y < 0 || y >= rows {
+			return
+		}
+		c := &cells[(wavY+y/4)*currentWidth+sub/2+1]
+		d := brailleDotsL[y%4]
+		if sub%2 == 1 {
+			d = brailleDotsR[y%4]
+		}
+		if c.Ch < brailleBlank || c.Ch > brailleBlank+0xff {
+			c.Ch = brailleBlank
+			c.Fg = fg
+		}
+		c.Ch = c.Ch | d
+		if force {
+			c.Fg = fg
+		}
+	}
+	rowOf := func(v int16) int {
+		return rows - 1 - (int(v)-yOffset)/yScale
+	}
+
+	traces := currentTraces()
+	ti := sort.Search(len(traces), func(i int) bool { return traces[i].aboveIndex >= first })
+	for ; ti < len(traces) && traces[ti].belowIndex-traces[ti].l1 <= last; ti++ {
+		t := traces[ti]
+		for sub := subOf(t.belowIndex - t.l1); sub < subOf(t.belowIndex); sub += 2 {
+			dot(sub, rowOf(t.fallThreshold), termbox.ColorMagenta, false)
+		}
+		for sub := subOf(t.belowIndex); sub < subOf(t.aboveIndex); sub += 2 {
+			dot(sub, rowOf(t.riseThreshold), termbox.ColorMagenta, false)
+		}
+		for y := 0; y < rows; y += 2 {
+			dot(subOf(t.belowIndex), y, termbox.ColorBlue, true)
+			dot(subOf(t.aboveIndex), y, termbox.ColorBlue, true)
+		}
+		dot(subOf(t.minIndex), rowOf(t.minVal), termbox.ColorCyan|termbox.AttrBold, true)
+		dot(subOf(t.maxIndex), rowOf(t.maxVal), termbox.ColorCyan|termbox.AttrBold, true)
+	}
+}
+
+// overlayLabel labels a bit with its value and the lengths of its halves,
+// if there is room for them.
+func overlayLabel(bt bitInfo, width int) string {
+	label := fmt.Sprintf("%d %d+%d", bt.v, bt.l1, bt.l2)
+	if !overlayVisible || width <= len(label) || overlayStatus() != "overlay" {
+		return fmt.Sprintf("%d", bt.v)
+	}
+	return label
+}
@@ -0,0 +1,291 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const projectExt = ".orictape"
+
+// A project records everything needed to pick up recovering a tape where we
+// left off: where the audio came from, how it was decoded, what was on screen
+// and any bookmarks and notes.
+type project struct {
+	Sources  []projectSource `json:"sources"`
+	Settings decoderSettings `json:"settings"`
+	View     projectView     `json:"view"`
+	Notes    []note          `json:"notes,omitempty"`
+	Fixes    []byteFix       `json:"fixes,omitempty"`
+}
+
+type projectSource struct {
+	Path    string `json:"path"`
+	SHA256  string `json:"sha256"`
+	Channel string `json:"channel"`
+	Invert  bool   `json:"invert"`
+	Filter  string `json:"filter,omitempty"`
+}
+
+type projectView struct {
+	Program    int  `json:"program"`
+	Cursor     int  `json:"cursor"`
+	HexStart   int  `json:"hexStart"`
+	BasicStart int  `json:"basicStart"`
+	BasicLeft  int  `json:"basicLeft"`
+	Focus      int  `json:"focus"`
+	WavZoom    int  `json:"wavZoom"`
+	WavPan     int  `json:"wavPan"`
+	Notes      bool `json:"notes"`
+}
+
+var proj *project
+var projectFile string
+
+func newProject(wavFile, channel string, invert bool, filter string, settings decoderSettings) (*project, error) {
+	if channel != "left" && channel != "right" {
+		return nil, fmt.Errorf("Unknown channel %q (expected left or right)", channel)
+	}
+	if _, ok := demodulators[settings.Demodulator]; !ok {
+		return nil, fmt.Errorf("Unknown demodulator %q (expected one of %s)", settings.Demodulator,
+			strings.Join(demodulatorNames, ", "))
+	}
+	if settings.Framing != "simple" && settings.Framing != "viterbi" {
+		return nil, fmt.Errorf("Unknown framing %q (expected one of %s)", settings.Framing,
+			strings.Join(framingNames, ", "))
+	}
+	if settings.Framing == "simple" {
+		settings.Framing = ""
+	}
+	if settings.Silence != "energy" && settings.Silence != "cycles" {
+		return nil, fmt.Errorf("Unknown silence detector %q (expected one of %s)", settings.Silence,
+			strings.Join(silenceNames, ", "))
+	}
+	if settings.Silence == "energy" {
+		settings.Silence = ""
+	}
+	hash, err := hashFile(wavFile)
+	if err != nil {
+		return nil, err
+	}
+	return &project{
+		Sources:  []projectSource{{Path: wavFile, SHA256: hash, Channel: channel, Invert: invert, Filter: filter}},
+		Settings: settings,
+		View:     projectView{WavZoom: int(zoomByte), Focus: int(paneHex)},
+	}, nil
+}
+
+// loadProject reads a project file. Source paths are stored relative to the
+// project file, so they are turned back into paths we can open.
+func loadProject(fileName string) (*project, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	p := &project{}
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+	if len(p.Sources) == 0 {
+		return nil, fmt.Errorf("%s: no source audio in project", fileName)
+	}
+	for i, src := range p.Sources {
+		if !filepath.IsAbs(src.Path) {
+			p.Sources[i].Path = filepath.Join(filepath.Dir(fileName), src.Path)
+		}
+	}
+	return p, nil
+}
+
+// reopenProject loads the project saved for a recording that is being opened
+// again. A project for a different recording isn't touched.
+func reopenProject(fileName, source string) (*project, error) {
+	p, err := loadProject(fileName)
+	if err != nil {
+		return nil, err
+	}
+	saved, err := os.Stat(p.Sources[0].Path)
+	if err != nil {
+		return nil, err
+	}
+	if opened, err := os.Stat(source); err != nil {
+		return nil, err
+	} else if !os.SameFile(saved, opened) {
+		return nil, fmt.Errorf("%s is the project for %s; open that, or give another project file with -project",
+			fileName, p.Sources[0].Path)
+	}
+	return p, nil
+}
+
+func saveProject(p *project, fileName string) error {
+	saved := *p
+	saved.Sources = make([]projectSource, len(p.Sources))
+	for i, src := range p.Sources {
+		saved.Sources[i] = src
+		if abs, err := filepath.Abs(src.Path); err == nil {
+			if dir, err := filepath.Abs(filepath.Dir(fileName)); err == nil {
+				if rel, err := filepath.Rel(dir, abs); err == nil {
+					saved.Sources[i].Path = rel
+				}
+			}
+		}
+	}
+	data, err := json.MarshalIndent(&saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, append(data, '\n'), 0644)
+}
+
+func hashFile(fileName string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkSource warns if a project source has changed since the project was
+// saved.
+func checkSource(src projectSource) error {
+	hash, err := hashFile(src.Path)
+	if err != nil {
+		return err
+	}
+	if src.SHA256 != "" && hash != src.SHA256 {
+		fmt.Printf("%s**** %s has changed since the project was saved ****%s\n", CLR_Y, src.Path, CLR_0)
+	}
+	return nil
+}
+
+// readSource reads the samples for a project source, picking the channel and
+// polarity it was recorded with. It warns if the file has changed since the
+// project was saved.
+func readSource(src projectSource, log io.Writer) (samples []int16, err error) {
+	if err = checkSource(src); err != nil {
+		return
+	}
+	left, right, err := readWavFile(src.Path, log)
+	if err != nil {
+		return
+	}
+	return sourceSamples(left, right, src)
+}
+
+// sourceSamples picks the channel of a source, inverts it and filters it as
+// the source says.
+func sourceSamples(left, right []int16, src projectSource) (samples []int16, err error) {
+	switch src.Channel {
+	case "left", "":
+		samples = left
+	case "right":
+		samples = right
+	default:
+		return nil, errors.New("Unknown channel " + src.Channel)
+	}
+
+	if src.Invert {
+		inverted := make([]int16, len(samples))
+		for i, v := range samples {
+			if v == -32768 {
+				inverted[i] = 32767
+			} else {
+				inverted[i] = -v
+			}
+		}
+		samples = inverted
+	}
+
+	switch src.Filter {
+	case "":
+	case "smooth":
+		// A three sample moving average takes the edge off hiss.
+		smoothed := make([]int16, len(samples))
+		for i := range samples {
+			sum := int(samples[i])
+			sum += int(samples[max(0, i-1)])
+			sum += int(samples[min(len(samples)-1, i+1)])
+			smoothed[i] = int16(sum / 3)
+		}
+		samples = smoothed
+	default:
+		return nil, errors.New("Unknown filter " + src.Filter)
+	}
+	return
+}
+
+// captureView records what the UI is showing in the project.
+func captureView() {
+	proj.View = projectView{
+		Program:    progIndex,
+		Cursor:     hexCursor,
+		HexStart:   hexStart,
+		BasicStart: basicStart,
+		BasicLeft:  basicLeft,
+		Focus:      int(focus),
+		WavZoom:    int(wavZoom),
+		WavPan:     wavPan,
+		Notes:      notesVisible,
+	}
+}
+
+// restoreView puts the UI back the way it was when the project was saved.
+func restoreView() {
+	v := proj.View
+	if v.Program < 0 || v.Program >= len(programs) {
+		return
+	}
+	notesVisible = v.Notes
+	focus = pane(max(0, min(int(numPanes)-1, v.Focus)))
+	if focus == paneNotes && !notesVisible {
+		focus = paneHex
+	}
+	wavZoom = zoomLevel(max(int(zoomCycle), min(int(zoomStream), v.WavZoom)))
+	if v.Program != progIndex {
+		loadProgram(v.Program)
+	}
+	moveHexCursor(max(0, min(len(prog.bytes)-1, v.Cursor)))
+	hexStart = max(0, min(len(prog.bytes)-1, v.HexStart))
+	basicStart = max(0, min(len(prog.lines)-1, v.BasicStart))
+	basicLeft = max(0, v.BasicLeft)
+	wavPan = v.WavPan
+	w, h := termbox.Size()
+	resetSize(w, h)
+	redrawAll()
+}
+
+func saveSession() {
+	captureView()
+	if err := saveProject(proj, projectFile); err != nil {
+		setStatusMessage(err.Error())
+	} else {
+		setStatusMessage("Saved project " + projectFile)
+	}
+}
@@ -0,0 +1,366 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const reportStyle = `
+body { font-family: sans-serif; margin: 1em 2em; }
+h2 { border-bottom: 1px solid #88f; }
+.wav { overflow-x: auto; border: 1px solid #ccc; }
+.wav svg { display: block; }
+.hex, .basic { font-family: monospace; white-space: pre; }
+.hex { max-height: 20em; overflow-y: auto; border: 1px solid #ccc; padding: 0.5em; }
+.basic { border: 1px solid #ccc; padding: 0.5em; }
+.chk { color: #d00; font-weight: bold; }
+.unc { color: #b80; font-weight: bold; }
+.mis { color: #a0a; font-weight: bold; }
+.fix { color: #088; font-weight: bold; }
+.sel { background: #bdf; }
+.line { cursor: pointer; }
+.line:hover { background: #eef; }
+.lenerr { color: #d00; }
+.sus { color: #b80; }
+.ctl { color: #a0a; background: #f4e8f4; }
+.note { color: #a0a; font-style: italic; }
+.off { color: #888; }
+.key { display: inline-block; width: 1em; height: 0.8em; margin: 0 0.3em 0 1em; }
+`
+
+const reportScript = `
+function sel(p, first, last, x0, x1) {
+  document.querySelectorAll('.sel').forEach(function(e) { e.classList.remove('sel'); });
+  for (var i = first; i <= last; i++) {
+    var b = document.getElementById('b' + p + '_' + i);
+    if (b) b.classList.add('sel');
+  }
+  var f = document.getElementById('b' + p + '_' + first);
+  if (f) f.scrollIntoView({block: 'nearest'});
+  var h = document.getElementById('hl' + p);
+  if (!h) return;
+  h.setAttribute('x', x0);
+  h.setAttribute('width', Math.max(2, x1 - x0));
+  var w = h.closest('.wav');
+  w.scrollLeft = x0 - w.clientWidth / 2;
+}
+`
+
+// Pixels in the report waveforms are at least this many samples wide, and
+// the waveforms are at most reportMaxWidth pixels wide.
+const reportSamplesPerPx = 8
+const reportMaxWidth = 20000
+const reportWavHeight = 120
+const reportTapeWidth = 1000
+
+var ansiEscapes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// reportText makes text from the decoder safe to put in the report.
+func reportText(s string) string {
+	s = ansiEscapes.ReplaceAllString(s, "")
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return '.'
+		}
+		return r
+	}, s)
+	return html.EscapeString(s)
+}
+
+// Control codes in Basic, each with the attribute letter after it if it is
+// an ESC.
+var controlCodes = regexp.MustCompile("\u241b[@-_]|[\u2400-\u241f]")
+
+// reportLine makes a Basic line safe to put in the report, marking its
+// control codes and saying what each does.
+func reportLine(s string) string {
+	return controlCodes.ReplaceAllStringFunc(reportText(s), func(c string) string {
+		r, size := utf8.DecodeRuneInString(c)
+		text := fmt.Sprintf("control code %d", r-controlPictures)
+		if len(c) > size {
+			text = "ESC " + c[size:] + ": " + attributeName(c[size]-'@')
+		}
+		return fmt.Sprintf("<span class=\"ctl\" title=\"%s\">%s</span>", text, c)
+	})
+}
+
+// writeReport writes a single, self contained html page showing each stream
+// on the tape, and for each program its bytes and basic listing with the
+// damaged parts highlighted.
+func writeReport(fileName string, streams []bitStream, programs []program) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+
+	title := "Tape recovery report"
+	if proj != nil && len(proj.Sources) > 0 {
+		title = title + ": " + filepath.Base(proj.Sources[0].Path)
+	}
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n", html.EscapeString(title))
+	fmt.Fprintf(w, "<style>%s</style>\n<script>%s</script>\n</head>\n<body>\n", reportStyle, reportScript)
+	fmt.Fprintf(w, "<h1>%s</h1>\n<p>%d streams, %d programs.</p>\n", html.EscapeString(title), len(streams), len(programs))
+	if len(streams) > 0 {
+		writeReportTape(w, streams)
+	}
+
+	for si, stream := range streams {
+		pi := -1
+		for i, p := range programs {
+			if p.stream.firstSample == stream.firstSample {
+				pi = i
+			}
+		}
+		fmt.Fprintf(w, "<h2>Stream %d at %.1fs", si+1, float64(stream.firstSample)/44100)
+		if pi >= 0 {
+			fmt.Fprintf(w, ": program %d &ldquo;%s&rdquo;", pi+1, reportText(programs[pi].name))
+		}
+		fmt.Fprintf(w, "</h2>\n<p>")
+		if stream.fragment != fragmentNone {
+			fmt.Fprintf(w, "A %s. ", streamKind(stream))
+		}
+		fmt.Fprintf(w, "%.1fs long, %d bits.</p>\n", float64(stream.lastSample-stream.firstSample)/44100, len(stream.bits))
+		for _, problem := range qualityProblems(stream.quality) {
+			fmt.Fprintf(w, "<p class=\"chk\">Recorded %s.</p>\n", html.EscapeString(problem))
+		}
+
+		if pi < 0 {
+			writeReportWav(w, -1, stream, program{stream: stream})
+			continue
+		}
+		writeReportProgram(w, pi, programs[pi])
+	}
+	for pi, p := range programs {
+		if !hasAudio(p) {
+			fmt.Fprintf(w, "<h2>Program %d &ldquo;%s&rdquo; at byte %d of the .tap file</h2>\n", pi+1, reportText(p.name), p.offset)
+			writeReportProgram(w, pi, p)
+		}
+	}
+
+	fmt.Fprintf(w, "</body>\n</html>\n")
+	return w.Flush()
+}
+
+// writeReportProgram writes what was read of a program: a summary of its
+// damage, its wave if it was read from a recording, its bytes and listing,
+// and the notes on it. It is drawn from the stream the program was read from.
+func writeReportProgram(w *bufio.Writer, pi int, p program) {
+	var chkErrs, unclear, missing, lenErrs int
+	for _, bti := range p.bytes {
+		if bti.missing {
+			missing++
+		}
+		if bti.chkErr {
+			chkErrs++
+		}
+		if bti.unclear {
+			unclear++
+		}
+	}
+	for _, l := range p.lines {
+		if l.lenErr {
+			lenErrs++
+		}
+	}
+	fmt.Fprintf(w, "<p>%d bytes: <span class=\"chk\">%d checksum errors</span>, <span class=\"unc\">%d unclear</span>, <span class=\"mis\">%d missing</span>; %d lines: <span class=\"lenerr\">%d line length errors</span>.</p>\n",
+		len(p.bytes), chkErrs, unclear, missing, len(p.lines), lenErrs)
+	if hasAudio(p) {
+		writeReportWav(w, pi, p.stream, p)
+	}
+	writeReportHex(w, pi, p)
+	writeReportBasic(w, pi, p)
+	writeReportNotes(w, pi, p)
+}
+
+// writeReportTape draws a map of the whole tape, showing where there is
+// signal and silence, and where the streams and fragments were read.
+func writeReportTape(w *bufio.Writer, streams []bitStream) {
+	samples := streams[0].samples
+	x := func(sample int) int {
+		return int(int64(sample) * reportTapeWidth / int64(max(1, len(samples))))
+	}
+	fmt.Fprintf(w, "<div class=\"wav\"><svg width=\"%d\" height=\"24\">\n", reportTapeWidth)
+	fmt.Fprintf(w, "<rect x=\"0\" y=\"0\" width=\"%d\" height=\"24\" fill=\"#eee\"/>\n", reportTapeWidth)
+	regions, floor, level := findSignal(samples)
+	for _, r := range regions {
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"0\" width=\"%d\" height=\"24\" fill=\"#bdb\"/>\n", x(r.first), x(r.last)-x(r.first)+1)
+	}
+	for si, st := range streams {
+		fill := "#48f"
+		if st.fragment != fragmentNone {
+			fill = "#fd6"
+		}
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"8\" width=\"%d\" height=\"8\" fill=\"%s\"><title>%d: %s at %.1fs</title></rect>\n",
+			x(st.firstSample), x(st.lastSample)-x(st.firstSample)+1, fill, si+1, streamKind(st), float64(st.firstSample)/44100)
+	}
+	fmt.Fprintf(w, "</svg></div>\n")
+	fmt.Fprintf(w, "<p><span class=\"key\" style=\"background: #bdb\"></span>signal <span class=\"key\" style=\"background: #eee\"></span>silence (noise floor %.0f, signal %.0f rms) <span class=\"key\" style=\"background: #48f\"></span>stream <span class=\"key\" style=\"background: #fd6\"></span>fragment</p>\n",
+		floor, level)
+}
+
+// reportScale returns the number of samples per pixel in a stream's waveform.
+func reportScale(stream bitStream) int {
+	return max(reportSamplesPerPx, (stream.lastSample-stream.firstSample)/reportMaxWidth+1)
+}
+
+func reportX(stream bitStream, sample int) int {
+	return (sample - stream.firstSample) / reportScale(stream)
+}
+
+func writeReportWav(w *bufio.Writer, pi int, stream bitStream, p program) {
+	scale := reportScale(stream)
+	width := reportX(stream, stream.lastSample) + 1
+	yScale := (int(stream.maxVal)-int(stream.minVal))/reportWavHeight + 1
+	y := func(v int16) int {
+		return reportWavHeight - 1 - (int(v)-int(stream.minVal))/yScale
+	}
+
+	fmt.Fprintf(w, "<div class=\"wav\"><svg width=\"%d\" height=\"%d\">\n", width, reportWavHeight)
+
+	// Shade the damaged bytes behind the trace.
+	for _, bti := range p.bytes {
+		fill := ""
+		switch {
+		case bti.missing:
+			fill = "#ccc"
+		case bti.chkErr:
+			fill = "#f88"
+		case bti.unclear:
+			fill = "#fd6"
+		default:
+			continue
+		}
+		x0 := reportX(stream, stream.bits[bti.firstBit].firstSample)
+		x1 := reportX(stream, stream.bits[bti.lastBit].lastSample)
+		fmt.Fprintf(w, "<rect x=\"%d\" y=\"0\" width=\"%d\" height=\"%d\" fill=\"%s\"/>\n", x0, x1-x0+1, reportWavHeight, fill)
+	}
+	if pi >= 0 {
+		for _, i := range programNotes(pi, p) {
+			f, l := proj.Notes[i].First, proj.Notes[i].Last
+			if f <= l {
+				fmt.Fprintf(w, "<rect x=\"%d\" y=\"0\" width=\"%d\" height=\"4\" fill=\"#c0c\"><title>%s</title></rect>\n",
+					reportX(stream, f), reportX(stream, l)-reportX(stream, f)+1, reportText(proj.Notes[i].describe(p)))
+			}
+		}
+		fmt.Fprintf(w, "<rect id=\"hl%d\" x=\"0\" y=\"0\" width=\"0\" height=\"%d\" fill=\"#48f\" fill-opacity=\"0.3\"/>\n", pi, reportWavHeight)
+	}
+
+	// Draw the min to max range of the samples under each pixel.
+	var path strings.Builder
+	for x := 0; x < width; x++ {
+		s := stream.firstSample + x*scale
+		e := min(s+scale, len(stream.samples))
+		if s >= e {
+			break
+		}
+		lo, hi := stream.samples[s], stream.samples[s]
+		for _, v := range stream.samples[s:e] {
+			lo = min16(lo, v)
+			hi = max16(hi, v)
+		}
+		fmt.Fprintf(&path, "M%d %dV%d", x, y(hi), y(lo)+1)
+	}
+	fmt.Fprintf(w, "<path d=\"%s\" stroke=\"#000\" stroke-width=\"1\" fill=\"none\"/>\n", path.String())
+	fmt.Fprintf(w, "</svg></div>\n")
+}
+
+func writeReportHex(w *bufio.Writer, pi int, p program) {
+	fmt.Fprintf(w, "<h3>Bytes</h3>\n<div class=\"hex\">")
+	for i, bti := range p.bytes {
+		if i%16 == 0 {
+			if i > 0 {
+				fmt.Fprintf(w, "\n")
+			}
+			fmt.Fprintf(w, "<span class=\"off\">%06x</span> ", i)
+		}
+		class, v := "", fmt.Sprintf("%02x", bti.v)
+		switch {
+		case bti.missing:
+			class, v = " class=\"mis\"", "??"
+		case bti.fixed:
+			class = " class=\"fix\""
+		case bti.chkErr:
+			class = " class=\"chk\""
+		case bti.unclear:
+			class = " class=\"unc\""
+		}
+		fmt.Fprintf(w, "<span id=\"b%d_%d\"%s>%s</span> ", pi, i, class, v)
+	}
+	fmt.Fprintf(w, "</div>\n")
+}
+
+func writeReportBasic(w *bufio.Writer, pi int, p program) {
+	if len(p.lines) == 0 {
+		fmt.Fprintf(w, "<p>Not a basic program.</p>\n")
+		return
+	}
+	fmt.Fprintf(w, "<h3>Basic listing</h3>\n<div class=\"basic\">")
+	for _, l := range p.lines {
+		class := "line"
+		if l.lenErr {
+			class = class + " lenerr"
+		}
+		var x0, x1 int
+		if hasAudio(p) {
+			first, last := byteSamples(p, l.firstByte, min(l.lastByte, len(p.bytes)-1))
+			x0, x1 = reportX(p.stream, first), reportX(p.stream, last)
+		}
+		fmt.Fprintf(w, "<div class=\"%s\" onclick=\"sel(%d,%d,%d,%d,%d)\">%s", class, pi, l.firstByte, l.lastByte, x0, x1, reportLine(l.v))
+		if l.lenErr {
+			fmt.Fprintf(w, "  <span class=\"off\">(expected %d bytes, found %d)</span>",
+				l.expectedLastByte-l.firstByte+1, l.lastByte-l.firstByte+1)
+		}
+		for _, text := range l.suspect {
+			fmt.Fprintf(w, "\n    <span class=\"sus\">! %s</span>", reportText(text))
+		}
+		for _, text := range noteTexts(notesOver(pi, p, l.firstByte, l.lastByte)) {
+			fmt.Fprintf(w, "\n    <span class=\"note\">; %s</span>", reportText(text))
+		}
+		fmt.Fprintf(w, "</div>")
+	}
+	fmt.Fprintf(w, "</div>\n")
+}
+
+func writeReportNotes(w *bufio.Writer, pi int, p program) {
+	notes := programNotes(pi, p)
+	if len(notes) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "<h3>Notes</h3>\n<ul>\n")
+	for _, i := range notes {
+		fmt.Fprintf(w, "<li class=\"note\">%s</li>\n", reportText(proj.Notes[i].describe(p)))
+	}
+	fmt.Fprintf(w, "</ul>\n")
+}
+
+// exportReport writes the report next to the project file.
+func exportReport() {
+	fileName := strings.TrimSuffix(projectFile, projectExt) + ".html"
+	if err := writeReport(fileName, streams, programs); err != nil {
+		setStatusMessage(err.Error())
+	} else {
+		setStatusMessage("Wrote report " + fileName)
+	}
+}
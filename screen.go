@@ -0,0 +1,321 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where the screens and character sets live in the Oric's memory.
+const (
+	hiresStart    = 0xa000 // 200 rows of 40 bytes
+	hiresRows     = 200
+	textStart     = 0xbb80 // 28 rows of 40 characters
+	textRows      = 28
+	textCharsets  = 0xb400 // standard, then alternate 0x400 on
+	hiresCharsets = 0x9800
+	romStart      = 0xc000
+	screenWidth   = 240
+)
+
+var oricPalette = color.Palette{
+	color.RGBA{0, 0, 0, 255}, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 255, 0, 255}, color.RGBA{255, 255, 0, 255},
+	color.RGBA{0, 0, 255, 255}, color.RGBA{255, 0, 255, 255}, color.RGBA{0, 255, 255, 255}, color.RGBA{255, 255, 255, 255},
+}
+
+type blockKind int
+
+const (
+	blockOther blockKind = iota
+	blockHires
+	blockText
+	blockCharset
+)
+
+func (k blockKind) String() string {
+	return []string{"memory block", "HIRES screen", "TEXT screen", "character set"}[k]
+}
+
+// blockKindOf says what a file that isn't Basic holds, from where it loads.
+func blockKindOf(h tapeHeader) blockKind {
+	inside := func(first, last int) bool { return h.start >= first && h.end <= last && h.start <= h.end }
+	switch {
+	case h.basic:
+		return blockOther
+	case h.start >= hiresStart && h.start < hiresStart+40 && h.end >= hiresStart+40*8:
+		return blockHires
+	case h.start >= textCharsets && h.end >= textStart && h.end < romStart:
+		// Screens are often saved with the character sets before them,
+		// or up to the end of memory after them.
+		return blockText
+	case inside(textCharsets, textStart-1), inside(hiresCharsets, hiresStart-1):
+		return blockCharset
+	}
+	return blockOther
+}
+
+// blockDescription describes a file that isn't Basic.
+func blockDescription(p program) string {
+	h := p.header
+	return fmt.Sprintf("%s, $%04X to $%04X", blockKindOf(*h), h.start, h.end)
+}
+
+// blockMemory returns the Oric's memory as it would be after loading a file:
+// the character sets in their places, then the file's bytes over them.
+func blockMemory(p program) []byte {
+	mem := make([]byte, 0x10000)
+	for _, base := range []int{textCharsets, hiresCharsets} {
+		copy(mem[base+32*8:], oricFont[:])
+		copy(mem[base+0x400+32*8:], mosaicFont())
+	}
+	h := p.header
+	for i := 0; h.start+i <= h.end && h.start+i < len(mem) && h.dataStart+i < len(p.bytes); i++ {
+		mem[h.start+i] = p.bytes[h.dataStart+i].v
+	}
+	return mem
+}
+
+// renderBlock draws a screen or character set, or returns nil if the file
+// isn't one.
+func renderBlock(p program) *image.Paletted {
+	if p.header == nil {
+		return nil
+	}
+	mem := blockMemory(p)
+	switch blockKindOf(*p.header) {
+	case blockHires:
+		return renderScreen(mem, true)
+	case blockText:
+		return renderScreen(mem, false)
+	case blockCharset:
+		var sets []int
+		for _, base := range []int{hiresCharsets, hiresCharsets + 0x400, textCharsets, textCharsets + 0x400} {
+			if p.header.start < base+0x400 && p.header.end >= base+32*8 {
+				sets = append(sets, base)
+			}
+		}
+		if len(sets) == 0 {
+			// Only the codes below 32, which aren't drawn.
+			return nil
+		}
+		return renderCharsets(mem, sets)
+	}
+	return nil
+}
+
+// renderScreen draws a HIRES or TEXT screen from memory. Each row starts in
+// white ink on black paper, and a byte with bits 5 and 6 clear is a serial
+// attribute that changes them (or the character set) for the rest of the
+// row, and shows as paper. Bit 7 inverts the colours of a byte.
+func renderScreen(mem []byte, hires bool) *image.Paletted {
+	base, rows, rowHeight := textStart, textRows, 8
+	if hires {
+		base, rows, rowHeight = hiresStart, hiresRows, 1
+	}
+	img := image.NewPaletted(image.Rect(0, 0, screenWidth, rows*rowHeight), oricPalette)
+	for row := 0; row < rows; row++ {
+		ink, paper := byte(7), byte(0)
+		charset, double := 0, false
+		for col := 0; col < 40; col++ {
+			b := mem[base+row*40+col]
+			var pattern [8]byte
+			switch {
+			case b&0x60 == 0:
+				switch a := b & 0x1f; {
+				case a < 8:
+					ink = a
+				case a < 16:
+					charset, double = int(a&1), a&2 != 0
+				case a < 24:
+					paper = a - 16
+				}
+			case hires:
+				pattern[0] = b & 0x3f
+			default:
+				glyph := textCharsets + charset*0x400 + int(b&0x7f)*8
+				for y := range pattern {
+					line := y
+					if double {
+						line = row%2*4 + y/2
+					}
+					pattern[y] = mem[glyph+line] & 0x3f
+				}
+			}
+			fg, bg := ink, paper
+			if b&0x80 != 0 {
+				fg, bg = fg^7, bg^7
+			}
+			for y := 0; y < rowHeight; y++ {
+				for x := 0; x < 6; x++ {
+					c := bg
+					if pattern[y]>>(5-x)&1 != 0 {
+						c = fg
+					}
+					img.SetColorIndex(col*6+x, row*rowHeight+y, c)
+				}
+			}
+		}
+	}
+	return img
+}
+
+// renderCharsets draws the characters 32 to 127 of each character set, 16
+// to a row with a gap between them, one set under another.
+func renderCharsets(mem []byte, sets []int) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, 16*8, len(sets)*6*10), oricPalette)
+	for si, base := range sets {
+		for c := 32; c < 128; c++ {
+			x0, y0 := (c%16)*8+1, si*60+(c/16-2)*10+1
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 6; x++ {
+					if mem[base+c*8+y]>>(5-x)&1 != 0 {
+						img.SetColorIndex(x0+x, y0+y, 7)
+					}
+				}
+			}
+		}
+	}
+	return img
+}
+
+// writeImage writes a screen or character set to a PNG file.
+func writeImage(fileName string, img image.Image) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err = png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// imageName returns a file name for a program's picture, from its number
+// and as much of its name as is safe in a file name.
+func imageName(pi int, name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+	return fmt.Sprintf("%d-%s.png", pi+1, name)
+}
+
+// writeImages writes every screen and character set on the tape as a PNG
+// file in a folder, and returns the names of the files.
+func writeImages(folder string, programs []program) (names []string, err error) {
+	if err = os.MkdirAll(folder, 0755); err != nil {
+		return
+	}
+	for pi, p := range programs {
+		if img := renderBlock(p); img != nil {
+			fileName := filepath.Join(folder, imageName(pi, p.name))
+			if err = writeImage(fileName, img); err != nil {
+				return
+			}
+			names = append(names, fileName)
+		}
+	}
+	return
+}
+
+var previewVisible bool
+var previewImage *image.Paletted
+
+func togglePreview() {
+	if previewVisible {
+		hidePreview()
+		return
+	}
+	if previewImage = renderBlock(prog); previewImage == nil {
+		setStatusMessage("Not a screen or character set")
+		return
+	}
+	previewVisible = true
+	redrawPreview()
+	termbox.Flush()
+}
+
+func hidePreview() {
+	previewVisible = false
+	termbox.Clear(fgCol, bgCol)
+	redrawAll()
+}
+
+// redrawPreview draws the picture over the panes, two pixels to a cell with
+// half blocks, scaled down until it fits.
+func redrawPreview() {
+	if !previewVisible {
+		return
+	}
+	for y := 0; y < statusY; y++ {
+		for x := 0; x < currentWidth; x++ {
+			termbox.SetCell(x, y, ' ', fgCol, bgCol)
+		}
+	}
+	title := " " + blockDescription(prog)
+	tbPrint(0, 0, fgCol|termbox.AttrBold, bgCol, title)
+	tbPrint(len(title)+3, 0, termbox.ColorBlue, bgCol, fmt.Sprintf("Enter writes a PNG, %s closes", keysFor("preview-image")))
+
+	b := previewImage.Bounds()
+	scale := 1
+	for b.Dx()/scale > currentWidth || b.Dy()/scale > 2*(statusY-1) {
+		scale++
+	}
+	colour := func(x, y int) termbox.Attribute {
+		// The Oric colours are the first eight of the terminal's.
+		return termbox.Attribute(previewImage.ColorIndexAt(x*scale, y*scale)) + 1
+	}
+	for y := 0; y < b.Dy()/scale/2; y++ {
+		for x := 0; x < b.Dx()/scale; x++ {
+			termbox.SetCell(x, 1+y, '▀', colour(x, 2*y), colour(x, 2*y+1))
+		}
+	}
+}
+
+// savePreview writes the picture being previewed next to the project file.
+func savePreview() {
+	fileName := strings.TrimSuffix(projectFile, projectExt) + "." + imageName(progIndex, prog.name)
+	if err := writeImage(fileName, previewImage); err != nil {
+		setStatusMessage(err.Error())
+	} else {
+		setStatusMessage("Wrote " + fileName)
+	}
+}
+
+func handlePreviewKey(ev termbox.Event) {
+	if ev.Key == termbox.KeyEsc {
+		hidePreview()
+		return
+	}
+	if ev.Key == termbox.KeyEnter {
+		savePreview()
+		hidePreview()
+		return
+	}
+	switch bindings[keySpec{ev.Key, ev.Ch}] {
+	case "quit", "preview-image", "help":
+		hidePreview()
+	}
+}
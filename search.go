@@ -0,0 +1,246 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"strconv"
+	"strings"
+)
+
+type searchMatch struct {
+	firstByte, lastByte int
+}
+
+var searchActive bool
+var searchQuery string
+var searchOrigin int
+var searchResults []searchMatch
+
+// findMatches returns every match of the query in the program, in byte
+// order. A query starting with "$" is a sequence of hex bytes, one starting
+// with ":" is a line number, and anything else is (case insensitive) basic
+// text.
+func findMatches(p program, query string) (matches []searchMatch) {
+	switch {
+	case strings.HasPrefix(query, "$"):
+		want, err := hex.DecodeString(strings.Replace(query[1:], " ", "", -1))
+		if err != nil || len(want) == 0 {
+			return
+		}
+	nextByte:
+		for i := 0; i+len(want) <= len(p.bytes); i++ {
+			for j, b := range want {
+				if p.bytes[i+j].v != b {
+					continue nextByte
+				}
+			}
+			matches = append(matches, searchMatch{i, i + len(want) - 1})
+		}
+	case strings.HasPrefix(query, ":"):
+		n, err := strconv.Atoi(query[1:])
+		if err != nil {
+			return
+		}
+		for _, l := range p.lines {
+			if l.elements[0] == fmt.Sprintf("%d ", n) {
+				matches = append(matches, searchMatch{l.firstByte, l.lastByte})
+			}
+		}
+	case query != "":
+		want := strings.ToUpper(query)
+		for _, l := range p.lines {
+			v := strings.ToUpper(l.v)
+			for c := strings.Index(v, want); c >= 0; {
+				// The line is measured in the cells it takes on screen.
+				first := textWidth(v[:c])
+				matches = append(matches, searchMatch{basicByteAt(l, first), basicByteAt(l, first+textWidth(want)-1)})
+				next := strings.Index(v[c+1:], want)
+				if next < 0 {
+					break
+				}
+				c = c + 1 + next
+			}
+		}
+	}
+	return
+}
+
+// nextMatch returns the index of the first match after (dir > 0) or before
+// (dir < 0) the given byte, wrapping around the ends of the program, or -1
+// if there are no matches.
+func nextMatch(matches []searchMatch, from, dir int) int {
+	if len(matches) == 0 {
+		return -1
+	}
+	if dir > 0 {
+		for i, m := range matches {
+			if m.firstByte > from {
+				return i
+			}
+		}
+		return 0
+	}
+	for i := len(matches) - 1; i >= 0; i-- {
+		if matches[i].firstByte < from {
+			return i
+		}
+	}
+	return len(matches) - 1
+}
+
+func showMatch(m searchMatch) {
+	moveHexCursor(m.firstByte)
+	setHexRange(m.firstByte, m.lastByte)
+}
+
+func startSearch() {
+	searchActive = true
+	searchQuery = ""
+	searchOrigin = hexCursor
+	searchResults = nil
+	redrawStatus()
+	termbox.Flush()
+}
+
+// updateSearch reruns the search as the query is typed, jumping to the first
+// match at or after where the search started.
+func updateSearch() {
+	searchResults = findMatches(prog, searchQuery)
+	if i := nextMatch(searchResults, searchOrigin-1, 1); i >= 0 {
+		showMatch(searchResults[i])
+	} else {
+		moveHexCursor(searchOrigin)
+		setHexRange(-1, -1)
+	}
+	redrawStatus()
+	termbox.Flush()
+}
+
+func handleSearchKey(ev termbox.Event) {
+	switch ev.Key {
+	case termbox.KeyEsc:
+		searchActive = false
+		moveHexCursor(searchOrigin)
+		setHexRange(-1, -1)
+	case termbox.KeyEnter:
+		searchActive = false
+		redrawStatus()
+		termbox.Flush()
+	case termbox.KeyBackspace, termbox.KeyBackspace2:
+		if len(searchQuery) > 0 {
+			searchQuery = searchQuery[:len(searchQuery)-1]
+			updateSearch()
+		}
+	case termbox.KeySpace:
+		searchQuery = searchQuery + " "
+		updateSearch()
+	default:
+		if ev.Ch != 0 {
+			searchQuery = searchQuery + string(ev.Ch)
+			updateSearch()
+		}
+	}
+}
+
+// repeatSearch moves to the next or previous match of the last search.
+func repeatSearch(dir int) {
+	searchResults = findMatches(prog, searchQuery)
+	if i := nextMatch(searchResults, hexCursor, dir); i >= 0 {
+		showMatch(searchResults[i])
+	} else {
+		setStatusMessage("No matches")
+	}
+}
+
+type problemKind int
+
+const (
+	problemChkErr problemKind = iota
+	problemUnclear
+	problemLenErr
+	problemMissing
+	problemSuspect
+)
+
+var problemNames = []string{"checksum error", "unclear byte", "line length error", "missing byte", "suspect line"}
+
+// problemBytes returns the start byte of every problem of the given kind in
+// the program, in byte order.
+func problemBytes(p program, kind problemKind) (bytes []int) {
+	switch kind {
+	case problemChkErr, problemUnclear, problemMissing:
+		for i, bti := range p.bytes {
+			if (kind == problemChkErr && bti.chkErr) || (kind == problemUnclear && bti.unclear) ||
+				(kind == problemMissing && bti.missing) {
+				bytes = append(bytes, i)
+			}
+		}
+	case problemLenErr, problemSuspect:
+		for _, l := range p.lines {
+			if (kind == problemLenErr && l.lenErr) || (kind == problemSuspect && len(l.suspect) > 0) {
+				bytes = append(bytes, l.firstByte)
+			}
+		}
+	}
+	return
+}
+
+// nextProblem moves the cursor to the next (dir > 0) or previous (dir < 0)
+// problem of the given kind.
+func nextProblem(kind problemKind, dir int) {
+	bytes := problemBytes(prog, kind)
+	if dir > 0 {
+		for _, b := range bytes {
+			if b > hexCursor {
+				moveHexCursor(b)
+				return
+			}
+		}
+	} else {
+		for i := len(bytes) - 1; i >= 0; i-- {
+			if bytes[i] < hexCursor {
+				moveHexCursor(bytes[i])
+				return
+			}
+		}
+	}
+	setStatusMessage(fmt.Sprintf("No more %ss", problemNames[kind]))
+}
+
+// problemStatus summarises how many problems of each kind are in the program
+// and how many of them are still ahead of the cursor.
+func problemStatus() string {
+	var parts []string
+	ahead := 0
+	for kind, name := range problemNames {
+		bytes := problemBytes(prog, problemKind(kind))
+		if len(bytes) == 0 {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d %ss", len(bytes), name))
+		for _, b := range bytes {
+			if b > hexCursor {
+				ahead++
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return "No problems"
+	}
+	return fmt.Sprintf("%s (%d after cursor)", strings.Join(parts, ", "), ahead)
+}
@@ -0,0 +1,91 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+var silenceNames = []string{"energy", "cycles"}
+
+// The envelope is the rms level of windows of this many samples (2ms).
+const envelopeWindow = 88
+
+// A signalRegion is a stretch of the tape, from its first to its last
+// sample, that is loud enough to be signal rather than silence.
+type signalRegion struct {
+	first, last int
+}
+
+// signalEnvelope returns the rms level of each window of the samples.
+func signalEnvelope(samples []int16) []float64 {
+	env := make([]float64, (len(samples)+envelopeWindow-1)/envelopeWindow)
+	for w := range env {
+		s := samples[w*envelopeWindow : min((w+1)*envelopeWindow, len(samples))]
+		var sum, sumSq float64
+		for _, v := range s {
+			sum += float64(v)
+			sumSq += float64(v) * float64(v)
+		}
+		mean := sum / float64(len(s))
+		env[w] = math.Sqrt(math.Max(0, sumSq/float64(len(s))-mean*mean))
+	}
+	return env
+}
+
+// signalLevels estimates the level of the silence (the noise floor) and of
+// the signal on a tape from its quietest and loudest windows.
+func signalLevels(env []float64) (floor, level float64) {
+	sorted := append([]float64(nil), env...)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)*2/100], sorted[len(sorted)*95/100]
+}
+
+// findSignal marks where the tape has signal on it. A region starts where the
+// envelope rises half way (in dB) from the noise floor to the signal level,
+// and carries on until it falls to half that, so the signal fading a little
+// doesn't split it. If the tape has no quiet stretches to tell apart from
+// the signal it is all signal.
+func findSignal(samples []int16) (regions []signalRegion, floor, level float64) {
+	env := signalEnvelope(samples)
+	if len(env) == 0 {
+		return
+	}
+	floor, level = signalLevels(env)
+	quiet := math.Max(floor, 1)
+	if level < 4*quiet {
+		return []signalRegion{{0, len(samples) - 1}}, floor, level
+	}
+	on := math.Sqrt(quiet * level)
+	off := on / 2
+
+	in := false
+	for w, e := range env {
+		switch {
+		case !in && e >= on:
+			in = true
+			// Take in the window before, where the signal was rising.
+			regions = append(regions, signalRegion{max(0, w-1) * envelopeWindow, 0})
+		case in && e < off:
+			in = false
+			regions[len(regions)-1].last = min(len(samples), (w+1)*envelopeWindow) - 1
+		}
+	}
+	if in {
+		regions[len(regions)-1].last = len(samples) - 1
+	}
+	return
+}
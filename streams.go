@@ -0,0 +1,167 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"github.com/nsf/termbox-go"
+)
+
+var streamListVisible bool
+var streamSel, streamTop int
+
+// streamProgram returns the index of the program read from a stream, or -1
+// if none was.
+func streamProgram(stream bitStream) int {
+	for pi, p := range programs {
+		if p.stream.firstSample == stream.firstSample {
+			return pi
+		}
+	}
+	return -1
+}
+
+// streamKind describes a stream for the lists of them.
+func streamKind(stream bitStream) string {
+	if stream.fragment == fragmentNone {
+		return "stream"
+	}
+	return fmt.Sprintf("%s fragment", stream.fragment)
+}
+
+func toggleStreamList() {
+	if streamListVisible {
+		hideStreamList()
+		return
+	}
+	if !needAudio("find streams in") {
+		return
+	}
+	streamListVisible = true
+	streamSel = streamIndex(prog.stream)
+	redrawStreamList()
+	termbox.Flush()
+}
+
+func hideStreamList() {
+	streamListVisible = false
+	termbox.Clear(fgCol, bgCol)
+	redrawAll()
+}
+
+// redrawStreamList lists every stream and fragment on the tape over the hex
+// and basic panes, with what was read from each.
+func redrawStreamList() {
+	if !streamListVisible {
+		return
+	}
+	top := hexHeaderY
+	for y := top; y < statusY; y++ {
+		for x := 0; x < currentWidth; x++ {
+			termbox.SetCell(x, y, ' ', fgCol, bgCol)
+		}
+	}
+	header := fmt.Sprintf(" %3s %8s %7s %6s %-9s %-17s %s", "#", "start", "length", "bits", "demod", "kind", "program")
+	tbPrint(0, top, fgCol|termbox.AttrBold, bgCol, header)
+	tbPrint(len(header)+3, top, termbox.ColorBlue, bgCol, fmt.Sprintf("Enter loads the program, %s closes", keysFor("stream-list")))
+
+	rows := statusY - top - 1
+	streamTop = max(0, min(streamTop, streamSel))
+	if streamSel >= streamTop+rows {
+		streamTop = streamSel - rows + 1
+	}
+	for i := streamTop; i < len(streams) && i < streamTop+rows; i++ {
+		st := streams[i]
+		text := "-"
+		if pi := streamProgram(st); pi >= 0 {
+			p := programs[pi]
+			text = fmt.Sprintf("#%d %s: %d bytes, %d lines", pi+1, p.name, len(p.bytes), len(p.lines))
+		}
+		fg := fgCol
+		switch {
+		case i == streamSel:
+			fg = curCol | termbox.AttrReverse
+		case st.fragment != fragmentNone:
+			fg = termbox.ColorYellow
+		}
+		mark := ' '
+		if st.firstSample == prog.stream.firstSample {
+			mark = '▶'
+		}
+		tbPrint(0, top+1+i-streamTop, fg, bgCol, fmt.Sprintf("%c%3d %7.1fs %6.1fs %6d %-9s %-17s %s",
+			mark, i+1, float64(st.firstSample)/44100, float64(st.lastSample-st.firstSample)/44100,
+			len(st.bits), st.demod, streamKind(st), text))
+	}
+}
+
+// loadStream switches to the program read from the selected stream.
+func loadStream() {
+	pi := streamProgram(streams[streamSel])
+	if pi < 0 {
+		setStatusMessage(fmt.Sprintf("No bytes were read from stream %d", streamSel+1))
+		return
+	}
+	loadProgram(pi)
+	hideStreamList()
+}
+
+func handleStreamListKey(ev termbox.Event) {
+	if ev.Key == termbox.KeyEsc {
+		hideStreamList()
+		return
+	}
+	if ev.Key == termbox.KeyEnter {
+		loadStream()
+		return
+	}
+	switch bindings[keySpec{ev.Key, ev.Ch}] {
+	case "quit", "stream-list", "help":
+		hideStreamList()
+		return
+	case "up":
+		streamSel = max(0, streamSel-1)
+	case "down":
+		streamSel = min(len(streams)-1, streamSel+1)
+	case "page-up":
+		streamSel = max(0, streamSel-(statusY-hexHeaderY-1))
+	case "page-down":
+		streamSel = min(len(streams)-1, streamSel+(statusY-hexHeaderY-1))
+	case "home":
+		streamSel = 0
+	case "end":
+		streamSel = len(streams) - 1
+	}
+	redrawStreamList()
+	termbox.Flush()
+}
+
+// handleStreamListMouse selects the stream clicked on, and loads its program
+// on a second click.
+func handleStreamListMouse(ev termbox.Event) {
+	if ev.Key != termbox.MouseLeft || ev.Mod&termbox.ModMotion != 0 {
+		return
+	}
+	i := streamTop + ev.MouseY - hexHeaderY - 1
+	if ev.MouseY <= hexHeaderY || ev.MouseY >= statusY || i >= len(streams) {
+		return
+	}
+	if i == streamSel {
+		loadStream()
+		return
+	}
+	streamSel = i
+	redrawStreamList()
+	termbox.Flush()
+}
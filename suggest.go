@@ -0,0 +1,481 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The symbols of the n-gram model are the 256 byte values and a marker for
+// the start and end of a line.
+const lineBoundary = 256
+const ngramSymbols = 257
+
+const maxSuggestions = 8
+
+// An ngramModel predicts each byte of a line of Basic, as stored with its
+// keywords tokenised, from the two before it.
+type ngramModel struct {
+	uni, biCtx [ngramSymbols]int
+	total      int
+	bi, triCtx map[[2]int]int
+	tri        map[[3]int]int
+}
+
+func newNgramModel() *ngramModel {
+	return &ngramModel{bi: map[[2]int]int{}, triCtx: map[[2]int]int{}, tri: map[[3]int]int{}}
+}
+
+// addLine counts the n-grams of a line. Any that include a byte that isn't
+// good are left out.
+func (m *ngramModel) addLine(body []byte, good func(i int) bool) {
+	syms := lineSymbols(body)
+	ok := func(j int) bool {
+		return j < 2 || j == len(syms)-1 || good == nil || good(j-2)
+	}
+	for j := 2; j < len(syms); j++ {
+		if !ok(j) {
+			continue
+		}
+		m.uni[syms[j]]++
+		m.total++
+		if !ok(j - 1) {
+			continue
+		}
+		m.bi[[2]int{syms[j-1], syms[j]}]++
+		m.biCtx[syms[j-1]]++
+		if !ok(j - 2) {
+			continue
+		}
+		m.tri[[3]int{syms[j-2], syms[j-1], syms[j]}]++
+		m.triCtx[[2]int{syms[j-2], syms[j-1]}]++
+	}
+}
+
+// cost returns how unlikely c is to follow a and b, as a negative log
+// probability, mixing the trigram, bigram and unigram estimates.
+func (m *ngramModel) cost(a, b, c int) float64 {
+	p1 := float64(m.uni[c]+1) / float64(m.total+ngramSymbols)
+	p2 := p1
+	if n := m.biCtx[b]; n > 0 {
+		p2 = float64(m.bi[[2]int{b, c}]) / float64(n)
+	}
+	p3 := p2
+	if n := m.triCtx[[2]int{a, b}]; n > 0 {
+		p3 = float64(m.tri[[3]int{a, b, c}]) / float64(n)
+	}
+	return -math.Log(0.6*p3 + 0.3*p2 + 0.1*p1)
+}
+
+// lineSymbols returns the symbols of a line, with two boundaries before it
+// and one after.
+func lineSymbols(body []byte) []int {
+	syms := []int{lineBoundary, lineBoundary}
+	for _, b := range body {
+		syms = append(syms, int(b))
+	}
+	return append(syms, lineBoundary)
+}
+
+// tokeniseLine turns a line of a listing into the line number and the bytes
+// Basic would store for it, tokenising keywords as the Oric does: anywhere
+// outside strings, REM and DATA.
+func tokeniseLine(text string) (number int, body []byte, ok bool) {
+	text = strings.TrimSpace(text)
+	i := 0
+	for ; i < len(text) && text[i] >= '0' && text[i] <= '9'; i++ {
+		number = number*10 + int(text[i]-'0')
+	}
+	if i == 0 {
+		return 0, nil, false
+	}
+	text = strings.TrimLeft(text[i:], " ")
+	inString, inData := false, false
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case inString:
+			inString = c != '"'
+		case c == '"':
+			inString = true
+		case inData:
+			inData = c != ':'
+		default:
+			best := -1
+			for ki, kw := range keywords {
+				if strings.HasPrefix(text[i:], kw) && (best < 0 || len(kw) > len(keywords[best])) {
+					best = ki
+				}
+			}
+			if best >= 0 {
+				body = append(body, byte(128+best))
+				i += len(keywords[best])
+				switch keywords[best] {
+				case "REM":
+					return number, append(body, text[i:]...), true
+				case "DATA":
+					inData = true
+				}
+				continue
+			}
+		}
+		body = append(body, c)
+		i++
+	}
+	return number, body, true
+}
+
+// The folder of known good listings to learn from, and the lines read from
+// it, once they have been.
+var corpusDir string
+var corpusLines [][]byte
+var corpusRead bool
+
+// defaultCorpusDir returns where the listings are kept if no other folder
+// was given.
+func defaultCorpusDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".orictape-corpus")
+}
+
+// readCorpus reads every line of every listing under a folder.
+func readCorpus(dir string) (lines [][]byte) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if _, body, ok := tokeniseLine(scanner.Text()); ok {
+				lines = append(lines, body)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// buildModel trains a model on the corpus and on the undamaged bytes of the
+// programs on the tape.
+func buildModel(programs []program) *ngramModel {
+	if !corpusRead {
+		dir := corpusDir
+		if dir == "" {
+			dir = defaultCorpusDir()
+		}
+		corpusLines, corpusRead = readCorpus(dir), true
+	}
+	m := newNgramModel()
+	for _, body := range corpusLines {
+		m.addLine(body, nil)
+	}
+	for _, p := range programs {
+		for _, l := range p.lines {
+			first, body := lineBody(p, l)
+			m.addLine(body, func(i int) bool {
+				b := p.bytes[first+i]
+				return !b.chkErr && !b.unclear && !b.missing
+			})
+		}
+	}
+	return m
+}
+
+// lineBody returns the bytes of a line after its link and line number, up to
+// its terminating 0, and the index of the first of them.
+func lineBody(p program, l lineInfo) (first int, body []byte) {
+	first = l.firstByte + 4
+	for i := first; i <= l.lastByte && i < len(p.bytes) && p.bytes[i].v != 0; i++ {
+		body = append(body, p.bytes[i].v)
+	}
+	return
+}
+
+// A suggestion is a value a damaged byte might have had, with how unlikely
+// it is given the audio and given the Basic around it, and its probability
+// among the suggestions.
+type suggestion struct {
+	v                 byte
+	flips             int
+	channel, language float64
+	p                 float64
+}
+
+// suggestByte ranks the values a byte might have had. How well each fits the
+// audio is scored like Viterbi framing scores bits and parity, so values that
+// differ only in doubtful bits, and keep the parity, cost the least. Bytes in
+// a line of Basic are also scored by how well they fit between the bytes
+// either side of them.
+func suggestByte(p program, i int, m *ngramModel, settings decoderSettings) (sugs []suggestion) {
+	bti := p.bytes[i]
+	bits := p.stream.bits
+	hasBits := !bti.missing && bti.lastBit < len(bits) && bti.lastBit-8 >= 0
+	var decoded byte
+	if hasBits {
+		for k := 0; k < 8; k++ {
+			decoded |= byte(bits[bti.lastBit-8+k].v) << uint(k)
+		}
+	}
+
+	// Where the byte sits in its line, if it is in one.
+	var syms []int
+	j := -1
+	li := sort.Search(len(p.lines), func(li int) bool { return p.lines[li].lastByte >= i })
+	if li < len(p.lines) {
+		first, body := lineBody(p, p.lines[li])
+		if i >= first && i < first+len(body) {
+			syms, j = lineSymbols(body), i-first+2
+		}
+	}
+
+	for v := 0; v < 256; v++ {
+		s := suggestion{v: byte(v)}
+		if hasBits {
+			ones := 0
+			for k := 0; k < 8; k++ {
+				b := bit(v >> uint(k) & 1)
+				s.channel += bitCost(bits[bti.lastBit-8+k], b, settings)
+				ones += int(b)
+			}
+			// Odd parity: the parity bit makes the number of 1s odd.
+			parity := bits[bti.lastBit]
+			s.channel += math.Min(bitCost(parity, bit(1-ones%2), settings),
+				bitCost(parity, bit(ones%2), settings)+parityCost)
+			for x := decoded ^ byte(v); x != 0; x &= x - 1 {
+				s.flips++
+			}
+		}
+		if j >= 0 {
+			s.language = m.cost(syms[j-2], syms[j-1], v) + m.cost(syms[j-1], v, syms[j+1])
+			if j+2 < len(syms) {
+				s.language += m.cost(v, syms[j+1], syms[j+2])
+			}
+		}
+		sugs = append(sugs, s)
+	}
+
+	sort.SliceStable(sugs, func(a, b int) bool {
+		return sugs[a].channel+sugs[a].language < sugs[b].channel+sugs[b].language
+	})
+	best := sugs[0].channel + sugs[0].language
+	sum := 0.0
+	for k := range sugs {
+		sugs[k].p = math.Exp(best - sugs[k].channel - sugs[k].language)
+		sum += sugs[k].p
+	}
+	for k := range sugs {
+		sugs[k].p /= sum
+	}
+	return sugs[:maxSuggestions]
+}
+
+// byteText shows how a byte reads in a listing.
+func byteText(v byte) string {
+	switch {
+	case v >= 128 && int(v-128) < len(keywords):
+		return keywords[v-128]
+	case v >= 32 && v < 127:
+		return fmt.Sprintf("'%c'", oricRune(v))
+	}
+	return fmt.Sprintf("CHR$(%d)", v)
+}
+
+// A byteFix is a value the user chose for a damaged byte, and the value it
+// was read as. It is kept by the sample in the middle of the byte, so it
+// stays on the same byte when the tape is decoded again, and is only used if
+// the byte there still reads as it did.
+type byteFix struct {
+	Sample int  `json:"sample"`
+	Value  byte `json:"value"`
+	Was    byte `json:"was"`
+}
+
+// byteMiddle returns the sample in the middle of a byte.
+func byteMiddle(p program, i int) int {
+	first, last := byteSamples(p, i, i)
+	return (first + last) / 2
+}
+
+// byteIndex returns which byte of a program a fix is on, or -1.
+func (f byteFix) byteIndex(p program) int {
+	i := sort.Search(len(p.bytes), func(i int) bool {
+		_, last := bytePlace(p, i)
+		return last >= f.Sample
+	})
+	if first, _ := bytePlace(p, min(i, len(p.bytes)-1)); i == len(p.bytes) || first > f.Sample {
+		return -1
+	}
+	return i
+}
+
+// applyFixes sets the bytes the user has chosen values for, keeping the
+// bytes as they were read, and reads the lines of those programs again.
+func applyFixes(programs []program) {
+	if proj == nil || len(proj.Fixes) == 0 {
+		return
+	}
+	for pi := range programs {
+		p := &programs[pi]
+		fixed := false
+		for _, f := range proj.Fixes {
+			i := f.byteIndex(*p)
+			if i < 0 || p.bytes[i].fixed || p.bytes[i].v != f.Was {
+				continue
+			}
+			if p.unfixed == nil {
+				p.unfixed = map[int]byteInfo{}
+			}
+			p.unfixed[i] = p.bytes[i]
+			b := &p.bytes[i]
+			b.v, b.fixed = f.Value, true
+			b.chkErr, b.unclear, b.missing = false, false, false
+			fixed = true
+		}
+		if fixed {
+			p.lines, p.name, p.header = nil, "", nil
+			readProgramLines(p, ioutil.Discard)
+		}
+	}
+}
+
+var suggestVisible bool
+var suggestSel, suggestByteIndex int
+var suggestions []suggestion
+
+func toggleSuggestions() {
+	if suggestVisible {
+		hideSuggestions()
+		return
+	}
+	suggestByteIndex = hexCursor
+	suggestions = suggestByte(prog, hexCursor, buildModel(programs), proj.Settings)
+	suggestVisible, suggestSel = true, 0
+	redrawSuggestions()
+	termbox.Flush()
+}
+
+func hideSuggestions() {
+	suggestVisible = false
+	termbox.Clear(fgCol, bgCol)
+	redrawAll()
+}
+
+// redrawSuggestions lists the likeliest values of the byte under the cursor
+// over the hex and basic panes.
+func redrawSuggestions() {
+	if !suggestVisible {
+		return
+	}
+	top := hexHeaderY
+	for y := top; y < statusY; y++ {
+		for x := 0; x < currentWidth; x++ {
+			termbox.SetCell(x, y, ' ', fgCol, bgCol)
+		}
+	}
+	bti := prog.bytes[suggestByteIndex]
+	title := fmt.Sprintf(" Byte %d, read as $%02x %s", suggestByteIndex, bti.v, byteText(bti.v))
+	if bti.missing {
+		title = fmt.Sprintf(" Byte %d, lost in a dropout", suggestByteIndex)
+	}
+	tbPrint(0, top, fgCol|termbox.AttrBold, bgCol, title)
+	tbPrint(len(title)+3, top, termbox.ColorBlue, bgCol, fmt.Sprintf("Enter uses the value, %s closes", keysFor("suggest")))
+	header := fmt.Sprintf(" %5s %-10s %5s %7s %8s %6s", "value", "reads as", "flips", "audio", "language", "chance")
+	tbPrint(0, top+1, fgCol|termbox.AttrBold, bgCol, header)
+	for k, s := range suggestions {
+		if top+2+k >= statusY {
+			break
+		}
+		fg := fgCol
+		if k == suggestSel {
+			fg = curCol | termbox.AttrReverse
+		}
+		tbPrint(0, top+2+k, fg, bgCol, fmt.Sprintf("   $%02x %-10s %5d %7.1f %8.1f %5.1f%%",
+			s.v, byteText(s.v), s.flips, s.channel, s.language, s.p*100))
+	}
+}
+
+// fixByte uses a suggested value for a byte, and keeps it in the project.
+// Choosing the value it was first read as takes the fix away again. Only the
+// current program is read again, so the rest of the tape is left as it is.
+func fixByte(i int, v byte) {
+	p := &programs[progIndex]
+	if p.bytes[i].fixed {
+		for fi, f := range proj.Fixes {
+			if f.byteIndex(*p) == i {
+				proj.Fixes = append(proj.Fixes[:fi], proj.Fixes[fi+1:]...)
+				break
+			}
+		}
+		p.bytes[i] = p.unfixed[i]
+		delete(p.unfixed, i)
+	}
+	if was := p.bytes[i].v; v != was {
+		proj.Fixes = append(proj.Fixes, byteFix{byteMiddle(*p, i), v, was})
+		setStatusMessage(fmt.Sprintf("Byte %d is now $%02x %s", i, v, byteText(v)))
+	} else {
+		setStatusMessage(fmt.Sprintf("Byte %d is back to $%02x as read", i, v))
+	}
+	p.lines, p.name, p.header = nil, "", nil
+	readProgramLines(p, ioutil.Discard)
+	applyFixes(programs[progIndex : progIndex+1])
+	prog = *p
+	termbox.Clear(fgCol, bgCol)
+	redrawAll()
+	moveHexCursor(i)
+}
+
+func handleSuggestKey(ev termbox.Event) {
+	if ev.Key == termbox.KeyEsc {
+		hideSuggestions()
+		return
+	}
+	if ev.Key == termbox.KeyEnter {
+		suggestVisible = false
+		fixByte(suggestByteIndex, suggestions[suggestSel].v)
+		hideSuggestions()
+		return
+	}
+	switch bindings[keySpec{ev.Key, ev.Ch}] {
+	case "quit", "suggest", "help":
+		hideSuggestions()
+		return
+	case "up":
+		suggestSel = max(0, suggestSel-1)
+	case "down":
+		suggestSel = min(len(suggestions)-1, suggestSel+1)
+	case "home":
+		suggestSel = 0
+	case "end":
+		suggestSel = len(suggestions) - 1
+	}
+	redrawSuggestions()
+	termbox.Flush()
+}
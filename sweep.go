@@ -0,0 +1,394 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// parallel calls f for each of 0 to n-1, spread over all the CPUs.
+func parallel(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for w := 0; w < min(n, runtime.NumCPU()); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
+
+// A candidate is one combination of source and decoder settings to try.
+type candidate struct {
+	source   projectSource
+	settings decoderSettings
+}
+
+func (c candidate) String() string {
+	s := fmt.Sprintf("%s channel", c.source.Channel)
+	if c.source.Invert {
+		s = s + ", inverted"
+	}
+	if c.source.Filter != "" {
+		s = s + ", " + c.source.Filter
+	}
+	return fmt.Sprintf("%s, short %d, long %d", s, c.settings.ShortThreshold, c.settings.LongThreshold)
+}
+
+// sweepCandidates returns the variations on a source and settings to try:
+// both channels and polarities, with and without smoothing, and thresholds
+// either side of the current ones. The current settings come first.
+func sweepCandidates(src projectSource, settings decoderSettings) []candidate {
+	settings.Sweep = false
+	cands := []candidate{{src, settings}}
+	for _, channel := range []string{"left", "right"} {
+		for _, invert := range []bool{false, true} {
+			for _, filter := range []string{"", "smooth"} {
+				for _, ds := range []int{-2, 0, 2} {
+					for _, dl := range []int{-2, 0, 2} {
+						c := candidate{src, settings}
+						c.source.Channel, c.source.Invert, c.source.Filter = channel, invert, filter
+						c.settings.ShortThreshold += ds
+						c.settings.LongThreshold += dl
+						if c.settings.ShortThreshold < c.settings.LongThreshold && (c.source != src || ds != 0 || dl != 0) {
+							cands = append(cands, c)
+						}
+					}
+				}
+			}
+		}
+	}
+	return cands
+}
+
+// A programScore ranks decodes of a program: fewest errors first, then fewest
+// unclear bytes, then the most bytes.
+type programScore struct {
+	errors, unclear, bytes int
+}
+
+func scoreProgram(p program) programScore {
+	return programScore{
+		errors: len(problemBytes(p, problemChkErr)) + len(problemBytes(p, problemLenErr)) +
+			len(problemBytes(p, problemMissing)),
+		unclear: len(problemBytes(p, problemUnclear)),
+		bytes:   len(p.bytes),
+	}
+}
+
+func (a programScore) better(b programScore) bool {
+	switch {
+	case a.errors != b.errors:
+		return a.errors < b.errors
+	case a.unclear != b.unclear:
+		return a.unclear < b.unclear
+	}
+	return a.bytes > b.bytes
+}
+
+// programSpan returns the first and last samples of a program's bytes.
+func programSpan(p program) (first, last int) {
+	first, _ = bytePlace(p, 0)
+	_, last = bytePlace(p, len(p.bytes)-1)
+	return
+}
+
+// A sweepPick is the best decode found so far of one stretch of tape.
+type sweepPick struct {
+	prog  program
+	cand  int
+	score programScore
+}
+
+// A sweepResult is what a sweep found: the best decode of each program, and
+// the candidate to keep the settings of, with the samples it read and the
+// streams the tape splits into.
+type sweepResult struct {
+	picks   []sweepPick
+	stopped bool // early, so the current settings are kept
+	best    candidate
+	samples []int16
+	streams []bitStream
+}
+
+func (r sweepResult) programs() (programs []program) {
+	for _, pick := range r.picks {
+		programs = append(programs, pick.prog)
+	}
+	return
+}
+
+// sweep decodes the tape with every candidate, on all the CPUs, and keeps the
+// best decode of each program. Programs from different candidates that cover
+// the same part of the tape are the same program. Closing cancel stops it
+// early with the best found so far.
+func sweep(cands []candidate, cancel <-chan struct{}, progress func(done, total int)) (r sweepResult, err error) {
+	var picks []sweepPick
+	variants := map[projectSource][]int16{}
+	left, right, err := readWavFile(cands[0].source.Path, ioutil.Discard)
+	if err != nil {
+		return
+	}
+	for _, c := range cands {
+		if _, ok := variants[c.source]; !ok {
+			if variants[c.source], err = sourceSamples(left, right, c.source); err != nil {
+				return
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	var done int32
+	parallel(len(cands), func(i int) {
+		select {
+		case <-cancel:
+			return
+		default:
+		}
+		streams := readBitStreams(variants[cands[i].source], cands[i].settings, ioutil.Discard)
+		for _, p := range readPrograms(streams, cands[i].settings, ioutil.Discard) {
+			pick := sweepPick{p, i, scoreProgram(p)}
+			first, last := programSpan(p)
+			mu.Lock()
+			keep, best := true, picks[:0:0]
+			for _, other := range picks {
+				f, l := programSpan(other.prog)
+				if f > last || l < first {
+					best = append(best, other)
+					continue
+				}
+				// Ties go to the earlier candidate, so the result doesn't
+				// depend on which finished first.
+				if !pick.score.better(other.score) && (other.score.better(pick.score) || other.cand < i) {
+					keep = false
+					break
+				}
+			}
+			if keep {
+				picks = append(best, pick)
+			}
+			mu.Unlock()
+		}
+		progress(int(atomic.AddInt32(&done, 1)), len(cands))
+	})
+	sort.Slice(picks, func(i, j int) bool {
+		a, _ := programSpan(picks[i].prog)
+		b, _ := programSpan(picks[j].prog)
+		return a < b
+	})
+	select {
+	case <-cancel:
+		r.stopped = true
+	default:
+	}
+	return sweptTape(cands, picks, variants, r.stopped), nil
+}
+
+// sweptTape puts together the results of a sweep. The candidate that read the
+// most programs best is kept, unless the sweep was stopped early, and the tape
+// is split into streams as it reads it, with the streams of the programs
+// picked from other candidates in place of those they overlap.
+func sweptTape(cands []candidate, picks []sweepPick, variants map[projectSource][]int16, stopped bool) (r sweepResult) {
+	r.picks, r.stopped = picks, stopped
+	wins := make([]int, len(cands))
+	for _, pick := range picks {
+		wins[pick.cand]++
+	}
+	best := 0
+	for i := range cands {
+		if !stopped && wins[i] > wins[best] {
+			best = i
+		}
+	}
+	r.best, r.samples = cands[best], variants[cands[best].source]
+	programs := r.programs()
+	for _, st := range readBitStreams(r.samples, r.best.settings, ioutil.Discard) {
+		keep := true
+		for _, p := range programs {
+			if first, last := programSpan(p); st.firstSample <= last && st.lastSample >= first {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			r.streams = append(r.streams, st)
+		}
+	}
+	for _, p := range programs {
+		r.streams = append(r.streams, p.stream)
+	}
+	sort.Slice(r.streams, func(i, j int) bool { return r.streams[i].firstSample < r.streams[j].firstSample })
+	return
+}
+
+// keepSweep takes the source and settings of the candidate a sweep kept, and
+// the samples it read, so the tape is read the same way when it is decoded
+// again and when the project is saved and opened. The sweep isn't run again.
+func keepSweep(r sweepResult) {
+	proj.Sources[0] = r.best.source
+	proj.Settings = r.best.settings
+	tapeSamples, tapeLength = r.samples, len(r.samples)
+}
+
+// sweepFromCommandLine runs a sweep around the project's settings, showing
+// progress, until it finishes or Ctrl-C stops it.
+func sweepFromCommandLine() (sweepResult, error) {
+	cands := sweepCandidates(proj.Sources[0], proj.Settings)
+	cancel := make(chan struct{})
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		if _, ok := <-interrupt; ok {
+			close(cancel)
+		}
+	}()
+
+	r, err := sweep(cands, cancel, func(done, total int) {
+		fmt.Printf("\rSweeping decoder settings: %d of %d (Ctrl-C to stop)", done, total)
+	})
+	fmt.Println()
+	if err != nil {
+		return r, err
+	}
+	for _, pick := range r.picks {
+		fmt.Printf("[%s] best with %s: %d errors, %d unclear bytes\n",
+			pick.prog.name, cands[pick.cand], pick.score.errors, pick.score.unclear)
+	}
+	if r.stopped {
+		fmt.Println("Stopped early, so keeping the settings as they were")
+	} else {
+		fmt.Printf("Keeping the settings that read the most programs best: %s\n", r.best)
+	}
+	return r, nil
+}
+
+// A sweepRun is a sweep running in the background while the UI carries on.
+type sweepRun struct {
+	cancel      chan struct{}
+	stopped     bool // by the user, so its results are only kept for now
+	done, total int32
+	result      chan sweepResult
+}
+
+// sweeping is the sweep running in the background, or nil.
+var sweeping *sweepRun
+
+// startSweep runs a sweep in the background while the UI carries on. Its
+// progress is shown in the status bar, and the results replace the programs
+// when it finishes or is cancelled. A sweep already running around older
+// settings is dropped.
+func startSweep() {
+	cancelSweep()
+	s := &sweepRun{cancel: make(chan struct{}), result: make(chan sweepResult, 1)}
+	sweeping = s
+	cands := sweepCandidates(proj.Sources[0], proj.Settings)
+	s.total = int32(len(cands))
+	redrawStatus()
+	termbox.Flush()
+	go func() {
+		r, err := sweep(cands, s.cancel, func(done, total int) {
+			atomic.StoreInt32(&s.done, int32(done))
+			termbox.Interrupt()
+		})
+		if err != nil {
+			r.picks = nil
+		}
+		s.result <- r
+		termbox.Interrupt()
+	}()
+}
+
+// cancelSweep stops the sweep that is running, keeping the best it has found
+// until the tape is decoded again.
+func cancelSweep() {
+	if sweeping != nil && !sweeping.stopped {
+		sweeping.stopped = true
+		close(sweeping.cancel)
+	}
+}
+
+// sweepStatus describes the progress of a sweep for the status bar.
+func sweepStatus() string {
+	return fmt.Sprintf("Sweeping decoder settings: %d of %d (%s to stop)",
+		atomic.LoadInt32(&sweeping.done), sweeping.total, keysFor("sweep"))
+}
+
+// checkSweep shows the progress of a sweep, and takes its results once it has
+// finished. The settings that read the most programs best replace the
+// project's, unless the sweep was stopped early.
+func checkSweep() {
+	if sweeping == nil {
+		return
+	}
+	select {
+	case r := <-sweeping.result:
+		sweeping = nil
+		if len(r.picks) == 0 {
+			setStatusMessage("The sweep found no programs")
+			return
+		}
+		start, _ := programSpan(prog)
+		keepSweep(r)
+		streams, programs = r.streams, r.programs()
+		applyFixes(programs)
+		placeNotes(programs)
+		i := 0
+		for pi, p := range programs {
+			if f, _ := programSpan(p); f <= start {
+				i = pi
+			}
+		}
+		loadProgram(i)
+		if r.stopped {
+			setStatusMessage(fmt.Sprintf("Kept the best of each of %d programs until the tape is decoded again; the sweep was stopped, so the settings are as they were",
+				len(programs)))
+		} else {
+			setStatusMessage(fmt.Sprintf("Kept the best of each of %d programs, and the settings that read the most of them best: %s",
+				len(programs), r.best))
+		}
+	default:
+		redrawStatus()
+		termbox.Flush()
+	}
+}
+
+// toggleSweep starts a sweep, or stops the one that is running.
+func toggleSweep() {
+	if !needAudio("sweep the decoder settings over") {
+		return
+	}
+	if sweeping != nil {
+		cancelSweep()
+	} else {
+		startSweep()
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const tapExt = ".tap"
+
+func isTapFile(fileName string) bool {
+	return strings.HasSuffix(strings.ToLower(fileName), tapExt)
+}
+
+// needAudio says whether the tape was read from a recording, and if it was
+// read from a .tap file instead, tells the user there is no audio to do what
+// they asked with.
+func needAudio(what string) bool {
+	if isTapFile(proj.Sources[0].Path) {
+		setStatusMessage("A .tap file has no audio to " + what)
+		return false
+	}
+	return true
+}
+
+// tapFileAt returns where the header of a file starting at i begins: after
+// its sync bytes and the $24, with room for the header. It returns -1 if no
+// file starts there.
+func tapFileAt(data []byte, i int) int {
+	j := i
+	for j < len(data) && data[j] == 0x16 {
+		j++
+	}
+	if j == i || j+10 > len(data) || data[j] != 0x24 {
+		return -1
+	}
+	return j + 1
+}
+
+// tapFiles splits a .tap image into its files, each the sync bytes, the
+// $24 after them, the header, the name and as much of the data as the
+// header says there is, and returns where each starts. A header whose end
+// address is before its start doesn't say, so its file runs up to the next
+// one. Anything between the files is skipped.
+func tapFiles(data []byte) (files [][]byte, offsets []int) {
+	for i := 0; i < len(data); {
+		h := tapFileAt(data, i)
+		if h < 0 {
+			i++
+			continue
+		}
+		header := data[h : h+9]
+		end := h + 9
+		for end < len(data) && data[end] != 0 {
+			end++
+		}
+		end = min(len(data), end+1)
+		if length := int(header[4])<<8 | int(header[5]) - (int(header[6])<<8 | int(header[7])) + 1; length > 0 {
+			end = min(len(data), end+length)
+		} else {
+			for end < len(data) && tapFileAt(data, end) < 0 {
+				end++
+			}
+		}
+		files = append(files, data[i:end])
+		offsets = append(offsets, i)
+		i = end
+	}
+	return
+}
+
+// tapPrograms reads the files of a .tap image as programs, and says which
+// have headers that don't add up or are cut short, as it would for a tape.
+func tapPrograms(data []byte, log io.Writer) (programs []program) {
+	files, offsets := tapFiles(data)
+	for fi, file := range files {
+		p := program{offset: offsets[fi]}
+		for _, v := range file {
+			p.bytes = append(p.bytes, byteInfo{v: v, firstBit: -1, lastBit: -1})
+		}
+		readProgramLines(&p, log)
+		if h := p.header; h != nil && h.end < h.start {
+			fmt.Fprintf(log, "%s**** %s at byte %d: the header ends at $%04X, before it starts at $%04X ****%s\n",
+				CLR_R, p.name, p.offset, h.end, h.start, CLR_0)
+		} else if h != nil && len(p.bytes)-h.dataStart < h.end-h.start+1 {
+			fmt.Fprintf(log, "%s**** %s at byte %d: cut short, %d of %d bytes ****%s\n",
+				CLR_R, p.name, p.offset, len(p.bytes)-h.dataStart, h.end-h.start+1, CLR_0)
+		}
+		programs = append(programs, p)
+	}
+	return
+}
+
+// readTapFile reads the files of a .tap image as programs. There is no audio
+// behind them, so their bytes have no bits and are placed on the tape by
+// their offsets in the file, which is returned as the tape's length.
+func readTapFile(fileName string, log io.Writer) (programs []program, length int, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return
+	}
+	programs = tapPrograms(data, log)
+	fmt.Fprintf(log, "Read %d files from %s\n", len(programs), fileName)
+	return programs, len(data), nil
+}
@@ -0,0 +1,75 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// tapImage returns a file as a .tap image holds it: three sync bytes, the
+// $24, a header saying it loads from start to end, the name and the data.
+func tapImage(name string, start, end int, data ...byte) []byte {
+	b := []byte{0x16, 0x16, 0x16, 0x24, 0, 0, 0, 0, byte(end >> 8), byte(end), byte(start >> 8), byte(start), 0}
+	b = append(append(b, name...), 0)
+	return append(b, data...)
+}
+
+func join(parts ...[]byte) (b []byte) {
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return
+}
+
+func TestTapFiles(t *testing.T) {
+	a := tapImage("A", 0x500, 0x503, 1, 2, 3, 4)
+	b := tapImage("B", 0x500, 0x501, 5, 6)
+	bad := tapImage("BAD", 0x503, 0x500, 7, 8, 9)
+	tests := []struct {
+		name    string
+		data    []byte
+		files   [][]byte
+		offsets []int
+	}{
+		{"whole files", join(a, b), [][]byte{a, b}, []int{0, len(a)}},
+		{"truncated", a[:len(a)-2], [][]byte{a[:len(a)-2]}, []int{0}},
+		{"junk between files", join([]byte{0x16, 0x16, 0}, a, []byte("junk"), b),
+			[][]byte{a, b}, []int{3, 3 + len(a) + 4}},
+		{"bad header", join(bad, b), [][]byte{bad, b}, []int{0, len(bad)}},
+		{"too short for a header", a[:8], nil, nil},
+	}
+	for _, test := range tests {
+		files, offsets := tapFiles(test.data)
+		if !reflect.DeepEqual(files, test.files) || !reflect.DeepEqual(offsets, test.offsets) {
+			t.Errorf("%s: got files %v at %v, want %v at %v", test.name, files, offsets, test.files, test.offsets)
+		}
+	}
+}
+
+func TestTapCutShort(t *testing.T) {
+	// 10 PRINT"A" and 20 END, cut off in the middle of line 20.
+	basic := []byte{0x0a, 0x05, 10, 0, 0xba, '"', 'A', '"', 0, 0x10, 0x05, 20, 0, 0x80, 0, 0, 0}
+	image := tapImage("CUT", 0x501, 0x501+len(basic)-1, basic...)
+	programs := tapPrograms(image[:len(image)-5], ioutil.Discard)
+	if len(programs) != 1 {
+		t.Fatalf("got %d programs, want 1", len(programs))
+	}
+	lines := programs[0].lines
+	if len(lines) != 2 || lines[0].lenErr || !lines[1].lenErr {
+		t.Errorf("got lines %+v, want line 20 to have a length error", lines)
+	}
+}
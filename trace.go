@@ -0,0 +1,236 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A peakRecord is how the peak search found a cycle.
+type peakRecord struct {
+	MinIndex      int   `json:"minIndex"`
+	MinVal        int16 `json:"minVal"`
+	MaxIndex      int   `json:"maxIndex"`
+	MaxVal        int16 `json:"maxVal"`
+	FallThreshold int16 `json:"fallThreshold"`
+	RiseThreshold int16 `json:"riseThreshold"`
+	BelowIndex    int   `json:"belowIndex"`
+	AboveIndex    int   `json:"aboveIndex"`
+}
+
+// A cycleRecord is one line of a trace: a cycle, the bit it was read as and
+// where that bit went in the byte frame. Peak is only there for streams read
+// with the peak search, and a cycle that ended a run of signal has no bit.
+type cycleRecord struct {
+	Stream      int         `json:"stream"`
+	Demod       string      `json:"demod"`
+	FirstSample int         `json:"firstSample"`
+	LastSample  int         `json:"lastSample"`
+	Peak        *peakRecord `json:"peak,omitempty"`
+	L1          int         `json:"l1"`
+	L2          int         `json:"l2"`
+	Bit         *bit        `json:"bit"`
+	Unclear     bool        `json:"unclear"`
+	Confidence  float64     `json:"confidence,omitempty"`
+	Dropout     bool        `json:"dropout,omitempty"`
+	Clipped     bool        `json:"clipped,omitempty"`
+	Program     *int        `json:"program,omitempty"`
+	Byte        *int        `json:"byte,omitempty"`
+	Role        string      `json:"role,omitempty"`
+	DataBit     *int        `json:"dataBit,omitempty"`
+}
+
+var traceColumns = []string{"stream", "demod", "firstSample", "lastSample",
+	"minIndex", "minVal", "maxIndex", "maxVal", "fallThreshold", "riseThreshold", "belowIndex", "aboveIndex",
+	"l1", "l2", "bit", "unclear", "confidence", "dropout", "clipped", "program", "byte", "role", "dataBit"}
+
+// csvRow returns a record in the order of traceColumns, leaving out what it
+// doesn't have.
+func (r cycleRecord) csvRow() []string {
+	optional := func(p *int) string {
+		if p == nil {
+			return ""
+		}
+		return strconv.Itoa(*p)
+	}
+	row := []string{strconv.Itoa(r.Stream), r.Demod, strconv.Itoa(r.FirstSample), strconv.Itoa(r.LastSample)}
+	if p := r.Peak; p != nil {
+		row = append(row, strconv.Itoa(p.MinIndex), strconv.Itoa(int(p.MinVal)), strconv.Itoa(p.MaxIndex),
+			strconv.Itoa(int(p.MaxVal)), strconv.Itoa(int(p.FallThreshold)), strconv.Itoa(int(p.RiseThreshold)),
+			strconv.Itoa(p.BelowIndex), strconv.Itoa(p.AboveIndex))
+	} else {
+		row = append(row, "", "", "", "", "", "", "", "")
+	}
+	b := ""
+	if r.Bit != nil {
+		b = strconv.Itoa(int(*r.Bit))
+	}
+	return append(row, strconv.Itoa(r.L1), strconv.Itoa(r.L2), b, strconv.FormatBool(r.Unclear),
+		strconv.FormatFloat(r.Confidence, 'f', 3, 64), strconv.FormatBool(r.Dropout), strconv.FormatBool(r.Clipped),
+		optional(r.Program), optional(r.Byte), r.Role, optional(r.DataBit))
+}
+
+// parseSampleRange parses a range of samples written as first:last, where
+// either may be left out to run from the start or to the end.
+func parseSampleRange(s string) (first, last int, err error) {
+	first, last = 0, int(^uint(0)>>1)
+	if s == "" {
+		return
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("sample range %q should be first:last", s)
+	}
+	if parts[0] != "" {
+		if first, err = strconv.Atoi(parts[0]); err != nil {
+			return 0, 0, fmt.Errorf("sample range %q: %v", s, err)
+		}
+	}
+	if parts[1] != "" {
+		if last, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, fmt.Errorf("sample range %q: %v", s, err)
+		}
+	}
+	return
+}
+
+// traceRecords returns a record of every cycle in the streams between the
+// first and last samples, in order along the tape.
+func traceRecords(streams []bitStream, programs []program, settings decoderSettings, first, last int) (records []cycleRecord) {
+	for si, stream := range streams {
+		if stream.lastSample < first || stream.firstSample > last {
+			continue
+		}
+		var prog *program
+		progIndex := -1
+		for pi := range programs {
+			if programs[pi].stream.firstSample == stream.firstSample {
+				prog, progIndex = &programs[pi], pi
+			}
+		}
+		if prog != nil {
+			// Its bytes index the bits it was read from.
+			stream = prog.stream
+		}
+
+		// The peak search's own record of each cycle, by its last sample.
+		peaks := map[int]cycleTrace{}
+		if stream.demod == "peak" {
+			for _, t := range traceCycles(stream, settings) {
+				if t.noSignal {
+					if t.aboveIndex >= first && t.aboveIndex-t.l1-t.l2 <= last {
+						records = append(records, cycleRecord{Stream: si, Demod: stream.demod,
+							FirstSample: t.aboveIndex - t.l1 - t.l2, LastSample: t.aboveIndex - 1,
+							Peak: peakOf(t), L1: t.l1, L2: t.l2})
+					}
+					continue
+				}
+				peaks[t.aboveIndex-1] = t
+			}
+		}
+
+		for bi, b := range stream.bits {
+			if b.lastSample < first || b.firstSample > last {
+				continue
+			}
+			v := b.v
+			r := cycleRecord{Stream: si, Demod: stream.demod, FirstSample: b.firstSample, LastSample: b.lastSample,
+				L1: b.l1, L2: b.l2, Bit: &v, Unclear: b.unclear, Confidence: b.confidence,
+				Dropout: b.dropout, Clipped: b.clipped}
+			if t, ok := peaks[b.lastSample]; ok {
+				r.Peak = peakOf(t)
+			}
+			if prog != nil {
+				byteIndex := sort.Search(len(prog.bytes), func(i int) bool { return prog.bytes[i].lastBit >= bi })
+				if byteIndex < len(prog.bytes) && bi >= prog.bytes[byteIndex].firstBit {
+					pi := progIndex
+					r.Program, r.Byte = &pi, &byteIndex
+					role, pos := bitRoleAt(prog.bytes, bi)
+					r.Role = role.String(pos)
+					if role == roleData {
+						r.Role, r.DataBit = "data", &pos
+					}
+				}
+			}
+			records = append(records, r)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].LastSample < records[j].LastSample })
+	return
+}
+
+func peakOf(t cycleTrace) *peakRecord {
+	return &peakRecord{t.minIndex, t.minVal, t.maxIndex, t.maxVal, t.fallThreshold, t.riseThreshold,
+		t.belowIndex, t.aboveIndex}
+}
+
+// writeTrace writes a record of every cycle between the first and last
+// samples to a file, as CSV if its name ends in .csv and as JSON lines
+// otherwise.
+func writeTrace(fileName string, streams []bitStream, programs []program, settings decoderSettings, first, last int) (n int, err error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	records := traceRecords(streams, programs, settings, first, last)
+	if strings.HasSuffix(strings.ToLower(fileName), ".csv") {
+		err = writeTraceCSV(f, records)
+	} else {
+		enc := json.NewEncoder(f)
+		for _, r := range records {
+			if err = enc.Encode(r); err != nil {
+				break
+			}
+		}
+	}
+	return len(records), err
+}
+
+func writeTraceCSV(w io.Writer, records []cycleRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write(traceColumns)
+	for _, r := range records {
+		cw.Write(r.csvRow())
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportTrace writes a CSV trace of the cycles in the wave pane next to the
+// project file.
+func exportTrace() {
+	if !needAudio("trace the cycles of") {
+		return
+	}
+	first, last := wavRange()
+	fileName := strings.TrimSuffix(projectFile, projectExt) + ".trace.csv"
+	if n, err := writeTrace(fileName, streams, programs, proj.Settings, first, last); err != nil {
+		setStatusMessage(err.Error())
+	} else {
+		setStatusMessage(fmt.Sprintf("Wrote %d cycles to %s", n, fileName))
+	}
+}
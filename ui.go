@@ -17,6 +17,8 @@ package main
 import (
 	"fmt"
 	"github.com/nsf/termbox-go"
+	"sort"
+	"strings"
 )
 
 func tbPrint(x, y int, fg, bg termbox.Attribute, msg string) {
@@ -28,29 +30,20 @@ func tbPrint(x, y int, fg, bg termbox.Attribute, msg string) {
 
 const horizontalLine = '─'
 
+var tapeSamples []int16
+var tapeLength int // in samples, or bytes for a .tap file
+var signalMap []signalRegion
+var streams []bitStream
+var programs []program
+var progIndex int
 var prog program
 
-func mouse_button_num(k termbox.Key) int {
-	switch k {
-	case termbox.MouseLeft:
-		return 0
-	case termbox.MouseMiddle:
-		return 1
-	case termbox.MouseRight:
-		return 2
-	}
-	return 0
-}
+// Braille dot bits for each of the four rows in the left and right dot columns.
+var brailleDotsL = [4]rune{0x01, 0x02, 0x04, 0x40}
 
-var brailleRunesL = [4]rune{'⠁', '⠂', '⠄', '⡀'}
+var brailleDotsR = [4]rune{0x08, 0x10, 0x20, 0x80}
 
-var brailleRunesR = [4]rune{'⠈', '⠐', '⠠', '⢀'}
-
-var brailleRunesLR = [4][4]rune{
-	{'⠉', '⠑', '⠡', '⢁'},
-	{'⠊', '⠒', '⠢', '⢂'},
-	{'⠌', '⠔', '⠤', '⢄'},
-	{'⡈', '⡐', '⡠', '⣀'}}
+const brailleBlank = '\u2800'
 
 const bgCol = termbox.ColorDefault
 const fgCol = termbox.ColorDefault
@@ -58,7 +51,11 @@ const selCol = termbox.ColorWhite
 const curCol = termbox.ColorCyan
 
 var currentHeight, currentWidth int
+var paneWidth int
+var mapY, mapMarkY int
+var wavHeaderY int
 var wavY, wavHeight int
+var wavLabelY, wavRoleY int
 var hexHeaderY int
 var hexY, hexHeight, hexCols int
 var basicHeaderY int
@@ -70,17 +67,38 @@ func resetSize(w, h int) {
 
 	usedHeight := 0
 
+	// Tape map
+	mapY = usedHeight
+	mapMarkY = usedHeight + 1
+	usedHeight = usedHeight + 2
+
+	// Wav header
+	wavHeaderY = usedHeight
+	usedHeight++
+
 	// Wav
 	wavY = usedHeight
 	wavHeight = 4
 	usedHeight = usedHeight + wavHeight
 
+	// Wav bit values and roles
+	wavLabelY = usedHeight
+	wavRoleY = usedHeight + 1
+	usedHeight = usedHeight + 2
+
 	// Hex header
 	hexHeaderY = usedHeight
 	usedHeight++
 
+	// Notes panel, down the right hand side of the hex and basic panes.
+	paneWidth = w
+	if notesVisible {
+		notesWidth = min(40, w/3)
+		paneWidth = w - notesWidth
+	}
+
 	// Hex
-	hexCols = w / 3
+	hexCols = paneWidth / 3
 	hexY = usedHeight
 	hexHeight = (h - usedHeight - 1) / 2
 	usedHeight = usedHeight + hexHeight
@@ -101,71 +119,322 @@ func resetSize(w, h int) {
 	termbox.Clear(fgCol, bgCol)
 }
 
-func redrawWav() {
+type zoomLevel int
+
+const (
+	zoomCycle zoomLevel = iota
+	zoomByte
+	zoomLine
+	zoomStream
+)
+
+var zoomNames = []string{"cycle", "byte", "line", "stream"}
+
+var wavZoom = zoomByte
+var wavPan int
+
+// wavBit is the bit under the wave cursor, the cycle that cycle zoom shows.
+// When the hex cursor moves to another byte it goes to the byte's start bit.
+var wavBit int
+
+// startBit returns the bit a byte's frame starts with.
+func startBit(b byteInfo) int {
+	return max(b.firstBit, b.lastBit-9)
+}
+
+// wavZoomRange returns the first and last samples around the hex cursor at
+// the current zoom level, before any panning.
+func wavZoomRange() (first, last int) {
+	if !hasAudio(prog) {
+		return
+	}
+	bits := prog.stream.bits
 	bytei := prog.bytes[hexCursor]
+	switch wavZoom {
+	case zoomCycle:
+		first, last = bits[wavBit].firstSample, bits[wavBit].lastSample
+	case zoomByte:
+		first, last = bits[bytei.firstBit].firstSample, bits[bytei.lastBit].lastSample
+	case zoomLine:
+		s := max(0, min(hexSelStart, len(prog.bytes)-1))
+		e := max(s, min(hexSelEnd, len(prog.bytes)-1))
+		first, last = bits[prog.bytes[s].firstBit].firstSample, bits[prog.bytes[e].lastBit].lastSample
+	default:
+		first, last = bits[0].firstSample, bits[len(bits)-1].lastSample
+	}
+	return
+}
+
+// wavRange returns the first and last samples shown in the wav pane. This is
+// the zoom range shifted by wavPan, so panning never moves the cursor itself.
+func wavRange() (first, last int) {
+	first, last = wavZoomRange()
+	span := last - first
+	first = max(0, min(first+wavPan, len(prog.stream.samples)-1-span))
+	last = first + span
+	return
+}
+
+func zoomWav(delta int) {
+	z := zoomLevel(max(int(zoomCycle), min(int(zoomStream), int(wavZoom)+delta)))
+	if z != wavZoom {
+		wavZoom = z
+		wavPan = 0
+		refreshWav()
+	}
+}
+
+func panWav(delta int) {
+	first, last := wavRange()
+	wavPan = wavPan + delta*max(1, (last-first+1)/4)
+
+	// Don't let the pan run further than the edge of the recording.
+	zoomFirst, _ := wavZoomRange()
+	first, _ = wavRange()
+	wavPan = first - zoomFirst
+	refreshWav()
+}
+
+func refreshWav() {
+	redrawWav()
+	redrawHeaders()
+	termbox.Flush()
+}
+
+var heatRunes = []rune(" ▁▂▃▄▅▆▇█")
+
+// mapCol returns the column of the tape map that covers the given sample.
+func mapCol(sample int) int {
+	return max(0, min(currentWidth-1, int(int64(sample)*int64(currentWidth)/int64(max(1, tapeLength)))))
+}
+
+// cursorSample returns the sample at the start of the byte under the hex
+// cursor.
+func cursorSample() int {
+	first, _ := bytePlace(prog, hexCursor)
+	return first
+}
+
+// redrawMap draws an overview of the whole recording, showing where the
+// streams and programs are, how dense the damaged bytes are along the tape,
+// and where the cursor is.
+func redrawMap() {
+	type mapCell struct {
+		stream, fragment       bool
+		signal                 bool
+		bytes, chkErr, unclear int
+	}
+	mcs := make([]mapCell, currentWidth)
+	for _, r := range signalMap {
+		for x := mapCol(r.first); x <= mapCol(r.last); x++ {
+			mcs[x].signal = true
+		}
+	}
+	for _, st := range streams {
+		for x := mapCol(st.firstSample); x <= mapCol(st.lastSample); x++ {
+			mcs[x].stream = true
+			mcs[x].fragment = st.fragment != fragmentNone
+		}
+	}
+	for _, p := range programs {
+		for i, bti := range p.bytes {
+			first, _ := bytePlace(p, i)
+			mc := &mcs[mapCol(first)]
+			mc.bytes++
+			switch {
+			case bti.chkErr, bti.missing:
+				mc.chkErr++
+			case bti.unclear:
+				mc.unclear++
+			}
+		}
+	}
+
+	for x, mc := range mcs {
+		switch {
+		case mc.bytes > 0:
+			fg := termbox.ColorGreen
+			switch {
+			case mc.chkErr > 0:
+				fg = termbox.ColorRed
+			case mc.unclear > 0:
+				fg = termbox.ColorYellow
+			}
+			h := 1 + (len(heatRunes)-2)*(mc.chkErr+mc.unclear)/mc.bytes
+			termbox.SetCell(x, mapY, heatRunes[h], fg, bgCol)
+		case mc.fragment:
+			termbox.SetCell(x, mapY, '╌', termbox.ColorYellow, bgCol)
+		case mc.stream:
+			termbox.SetCell(x, mapY, horizontalLine, termbox.ColorBlue, bgCol)
+		case mc.signal:
+			// Signal with no stream read from it.
+			termbox.SetCell(x, mapY, '~', termbox.ColorBlue, bgCol)
+		default:
+			// Silence.
+			termbox.SetCell(x, mapY, '·', fgCol, bgCol)
+		}
+		termbox.SetCell(x, mapMarkY, ' ', fgCol, bgCol)
+	}
+
+	// Mark where each program starts, then the cursor.
+	for i, p := range programs {
+		fg := termbox.ColorBlue
+		if i == progIndex {
+			fg = curCol
+		}
+		name := p.name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		first, _ := bytePlace(p, 0)
+		tbPrint(mapCol(first), mapMarkY, fg, bgCol, "┃"+name)
+	}
+	termbox.SetCell(mapCol(cursorSample()), mapMarkY, '▲', curCol|termbox.AttrBold, bgCol)
+}
+
+// jumpToSample moves the cursor to the byte nearest to the given sample,
+// switching to whichever program is closest to it.
+func jumpToSample(sample int) {
+	best, bestDist := 0, -1
+	for i, p := range programs {
+		first, last := programSpan(p)
+		dist := max(0, max(first-sample, sample-last))
+		if bestDist < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	if best != progIndex {
+		loadProgram(best)
+	}
+	moveHexCursor(min(len(prog.bytes)-1, sort.Search(len(prog.bytes), func(i int) bool {
+		_, last := bytePlace(prog, i)
+		return last >= sample
+	})))
+}
+
+func redrawWav() {
 	bits := prog.stream.bits
 	samples := prog.stream.samples
+	first, last := wavRange()
+	span := last - first + 1
+	cols := currentWidth - 2
+	rows := 4 * wavHeight
 
-	// Clear existing wav.
+	// Clear existing wav and labels.
 	cells := termbox.CellBuffer()
 	s := wavY * currentWidth
-	e := s + wavHeight*currentWidth
+	e := (wavRoleY + 1) * currentWidth
 	for i := s; i < e; i++ {
 		cells[i].Ch = ' '
 	}
+	if !hasAudio(prog) {
+		tbPrint(1, wavY+wavHeight/2, fgCol, bgCol, "No audio behind the bytes of a .tap file")
+		return
+	}
+
+	// Find the first bit in view.
+	bi := sort.Search(len(bits), func(i int) bool { return bits[i].lastSample >= first })
 
-	// Draw new wav.
+	// Draw new wav, two braille dot columns per cell with each dot column
+	// covering the min to max range of the samples beneath it.
 	yOffset := int(prog.stream.minVal)
-	yScale := 1 + (int(prog.stream.maxVal)-int(prog.stream.minVal))/(4*wavHeight)
-	xOffset := bits[bytei.firstBit].firstSample
-	xScale := (100 * (bits[bytei.lastBit].lastSample - xOffset + 1)) / (currentWidth - 4)
-
-	fgLabel := fgCol
-	fgWav := fgCol | termbox.AttrBold
-	i := bytei.firstBit
-	bt := bits[i]
-	label := bit(255)
-	y := 4*(wavY+wavHeight) - 1
-	for x := 0; x < currentWidth-2; x++ {
-		j := xOffset + (xScale * x / 100)
-		if j > bt.lastSample {
-			label = bt.v
-			if bt.unclear {
-				fgLabel = termbox.ColorYellow
-			} else {
-				fgLabel = fgCol
+	yScale := 1 + (int(prog.stream.maxVal)-int(prog.stream.minVal))/rows
+	dots := make([]rune, wavHeight)
+	for x := 0; x < cols; x++ {
+		for i := range dots {
+			dots[i] = 0
+		}
+		for h := 0; h < 2; h++ {
+			sub := 2*x + h
+			a := first + sub*span/(2*cols)
+			b := max(a+1, first+(sub+1)*span/(2*cols))
+			// Include the previous sample so the trace joins up when zoomed in.
+			lo, hi := samples[max(first, a-1)], samples[max(first, a-1)]
+			for _, v := range samples[a:min(b, len(samples))] {
+				lo = min16(lo, v)
+				hi = max16(hi, v)
 			}
-			i++
-			bt = bits[i]
-			if bt.unclear {
-				fgWav = termbox.ColorYellow
-			} else {
-				fgWav = fgCol | termbox.AttrBold
+			ylo := rows - 1 - (int(hi)-yOffset)/yScale
+			yhi := rows - 1 - (int(lo)-yOffset)/yScale
+			for y := max(0, ylo); y <= min(rows-1, yhi); y++ {
+				if h == 0 {
+					dots[y/4] |= brailleDotsL[y%4]
+				} else {
+					dots[y/4] |= brailleDotsR[y%4]
+				}
 			}
 		}
 
-		y1 := y - (int(samples[j])-yOffset)/yScale
-		y2 := y - (int(samples[j+xScale/200])-yOffset)/yScale
-		if y1/4 == y2/4 {
-			termbox.SetCell(x+1, y1/4, brailleRunesLR[y1%4][y2%4], fgWav, bgCol)
-		} else {
-			termbox.SetCell(x+1, y1/4, brailleRunesL[y1%4], fgWav, bgCol)
-			termbox.SetCell(x+1, y2/4, brailleRunesR[y2%4], fgWav, bgCol)
+		j := first + x*span/cols
+		for bi < len(bits)-1 && bits[bi].lastSample < j {
+			bi++
 		}
-
-		if label != 255 {
-			switch {
-			case label == 1:
-				termbox.SetCell(x+1, wavY+wavHeight-1, '1', fgLabel, bgCol)
-			case label == 0:
-				termbox.SetCell(x+1, wavY+wavHeight-1, '0', fgLabel, bgCol)
-			default:
-				// Should never happen:
-				termbox.SetCell(x+1, wavY+wavHeight-1, '?', fgLabel, bgCol)
+		fgWav := fgCol | termbox.AttrBold
+		switch {
+		case bits[bi].clipped:
+			fgWav = termbox.ColorRed
+		case bits[bi].unclear:
+			fgWav = termbox.ColorYellow
+		}
+		for row, d := range dots {
+			if d != 0 {
+				termbox.SetCell(x+1, wavY+row, brailleBlank+d, fgWav, bgCol)
 			}
-			label = 255
 		}
+	}
+	if overlayVisible {
+		drawOverlay(first, last, yOffset, yScale)
+	}
+
+	// Label each bit in view with its value and role in the byte frame.
+	bi = sort.Search(len(bits), func(i int) bool { return bits[i].firstSample >= first })
+	curByte := prog.bytes[hexCursor]
+	for ; bi < len(bits) && bits[bi].firstSample <= last; bi++ {
+		bt := bits[bi]
+		x := (bt.firstSample - first) * cols / span
+		w := (bt.lastSample - bt.firstSample + 1) * cols / span
+		if w < 1 && bi > 0 && (bits[bi-1].firstSample-first)*cols/span == x {
+			// Too many bits per cell to label them all.
+			continue
+		}
+
+		fgLabel := fgCol
+		switch {
+		case bt.clipped:
+			fgLabel = termbox.ColorRed
+		case bt.unclear:
+			fgLabel = termbox.ColorYellow
+		}
+		if bt.dropout {
+			tbPrint(x+1, wavLabelY, termbox.ColorMagenta, bgCol, "dropout")
+			continue
+		}
+		tbPrint(x+1, wavLabelY, fgLabel, bgCol, overlayLabel(bt, w))
+
+		fgRole := termbox.ColorBlue
+		if bi >= curByte.firstBit && bi <= curByte.lastBit {
+			fgRole = curCol
+		}
+		if bi == wavBit {
+			fgRole = fgRole | termbox.AttrReverse
+		}
+		role, pos := bitRoleAt(prog.bytes, bi)
+		name := role.String(pos)
+		if w <= len(name) {
+			name = name[:1]
+		}
+		tbPrint(x+1, wavRoleY, fgRole, bgCol, name)
+	}
 
+	// Mark the samples that have notes on them.
+	for _, i := range programNotes(progIndex, prog) {
+		f, l := proj.Notes[i].First, proj.Notes[i].Last
+		if f > last || l < first {
+			continue
+		}
+		for x := (max(f, first) - first) * cols / span; x <= (min(l, last)-first)*cols/span && x < cols; x++ {
+			cells[wavLabelY*currentWidth+x+1].Bg = termbox.ColorMagenta
+		}
 	}
 }
 
@@ -173,19 +442,28 @@ var hexStart, hexEnd int
 
 func redrawHex() {
 	i := hexStart
-	for row := 0; row < hexHeight && i < len(prog.bytes); row++ {
+	marks := noteMarks(progIndex, prog, hexStart, hexStart+hexHeight*hexCols-1)
+	for row := 0; row < hexHeight; row++ {
 		for col := 0; col < hexCols; col++ {
 			if i < len(prog.bytes) {
 				bti := prog.bytes[i]
 				v := fmt.Sprintf("%02x", bti.v)
+				fg := fgCol
 				switch {
+				case bti.missing:
+					v = "??"
+					fg = termbox.ColorMagenta
+				case bti.fixed:
+					fg = termbox.ColorCyan
 				case bti.chkErr:
-					tbPrint(col*3+1, hexY+row, termbox.ColorRed, bgCol, v)
+					fg = termbox.ColorRed
 				case bti.unclear:
-					tbPrint(col*3+1, hexY+row, termbox.ColorYellow, bgCol, v)
-				default:
-					tbPrint(col*3+1, hexY+row, fgCol, bgCol, v)
+					fg = termbox.ColorYellow
+				}
+				if i-hexStart < len(marks) && marks[i-hexStart] {
+					fg = fg | termbox.AttrUnderline
 				}
+				tbPrint(col*3+1, hexY+row, fg, bgCol, v)
 				i++
 			} else {
 				tbPrint(col*3+1, hexY+row, fgCol, bgCol, "  ")
@@ -196,76 +474,228 @@ func redrawHex() {
 	hexEnd = i - 1
 }
 
-var basicStart int
+var basicStart, basicLeft int
 
 func redrawBasic() {
-	i := basicStart
-	for row := 0; row < basicHeight && i < len(prog.lines); row++ {
-		l := prog.lines[basicStart+row]
-		v := l.v
+	for row := 0; row < basicHeight; row++ {
+		var v []rune
 		fg := fgCol
-		if l.lenErr {
-			fg = termbox.ColorRed
+		mark := ' '
+		if basicStart+row < len(prog.lines) {
+			l := prog.lines[basicStart+row]
+			v = []rune(ansiEscapes.ReplaceAllString(l.v, ""))
+			switch {
+			case l.lenErr:
+				fg = termbox.ColorRed
+			case len(l.suspect) > 0:
+				fg = termbox.ColorYellow
+			}
+			if len(notesOver(progIndex, prog, l.firstByte, l.lastByte)) > 0 {
+				mark = '•'
+			}
 		}
-		for col := 0; col < currentWidth-1; col++ {
-			if col < len(v) {
-				termbox.SetCell(1+col, row+basicY, rune(v[col]), fg, bgCol)
+		termbox.SetCell(0, row+basicY, mark, termbox.ColorMagenta, bgCol)
+		for col := 0; col < paneWidth-1; col++ {
+			if i := basicLeft + col; i < len(v) {
+				// Control codes, and the attribute after an ESC, are magenta.
+				cfg := fg
+				if isControlPicture(v[i]) || i > 0 && v[i-1] == controlPictures+oricEsc {
+					cfg = termbox.ColorMagenta
+				}
+				termbox.SetCell(1+col, row+basicY, v[i], cfg, bgCol)
 			} else {
 				termbox.SetCell(1+col, row+basicY, ' ', fg, bgCol)
 			}
 		}
-		i++
 	}
 }
 
 var hexErrStatus string
 var hexWarnStatus string
+var hexRangeStatus string
 var basicErrStatus string
+var basicWarnStatus string
+var basicCodeStatus string
 
 type headerText struct {
 	fg   termbox.Attribute
 	text string
 }
 
-func drawHeader(y int, hts ...headerText) {
-	termbox.SetCell(0, y, horizontalLine, termbox.ColorBlue, bgCol)
+type pane int
+
+const (
+	paneWav pane = iota
+	paneHex
+	paneBasic
+	paneNotes
+	numPanes
+)
+
+var focus = paneHex
+
+// nextPane returns the pane after (dir > 0) or before (dir < 0) the focused
+// one, skipping the notes panel when it is hidden.
+func nextPane(dir int) pane {
+	p := (focus + numPanes + pane(dir)) % numPanes
+	if p == paneNotes && !notesVisible {
+		p = (p + numPanes + pane(dir)) % numPanes
+	}
+	return p
+}
+
+func setFocus(p pane) {
+	focus = p
+	redrawHeaders()
+	redrawNotes()
+	termbox.Flush()
+}
+
+// drawHeader draws the header line above a pane, highlighting it if that
+// pane has the keyboard focus.
+func drawHeader(p pane, y int, hts ...headerText) {
+	lineCol := termbox.ColorBlue
+	if p == focus {
+		lineCol = curCol
+	}
+	termbox.SetCell(0, y, horizontalLine, lineCol, bgCol)
 	x := 1
 	for _, ht := range hts {
 		for _, c := range ht.text {
 			termbox.SetCell(x, y, c, ht.fg, bgCol)
 			x++
 		}
-		termbox.SetCell(x, y, horizontalLine, termbox.ColorBlue, bgCol)
+		termbox.SetCell(x, y, horizontalLine, lineCol, bgCol)
 		x++
 	}
 	for ; x < currentWidth; x++ {
-		termbox.SetCell(x, y, horizontalLine, termbox.ColorBlue, bgCol)
+		termbox.SetCell(x, y, horizontalLine, lineCol, bgCol)
 	}
 
 }
 
 func redrawHeaders() {
-	switch {
-	case hexErrStatus != "" && hexWarnStatus != "":
-		drawHeader(hexHeaderY, headerText{termbox.ColorYellow, hexWarnStatus}, headerText{termbox.ColorRed, hexErrStatus})
-	case hexErrStatus != "":
-		drawHeader(hexHeaderY, headerText{termbox.ColorRed, hexErrStatus})
-	case hexWarnStatus != "":
-		drawHeader(hexHeaderY, headerText{termbox.ColorYellow, hexWarnStatus})
-	default:
-		drawHeader(hexHeaderY)
+	wavStatus := fmt.Sprintf("Wave: %s zoom, %s demodulator", zoomNames[wavZoom], prog.stream.demod)
+	if !hasAudio(prog) {
+		wavStatus = "Wave: none, read from a .tap file"
+	}
+	if proj.Settings.Framing != "" {
+		wavStatus = fmt.Sprintf("%s, %s framing", wavStatus, proj.Settings.Framing)
 	}
+	if wavPan != 0 {
+		wavStatus = fmt.Sprintf("%s, panned %+.3fs", wavStatus, float64(wavPan)/44100)
+	}
+	if overlayVisible {
+		wavStatus = fmt.Sprintf("%s, %s", wavStatus, overlayStatus())
+	}
+	progStatus := fmt.Sprintf("Program %d of %d", progIndex+1, len(programs))
+	if prog.name != "" {
+		progStatus = fmt.Sprintf("%s \"%s\"", progStatus, prog.name)
+	}
+	hts := []headerText{{fgCol, progStatus}, {fgCol, wavStatus}}
+	if q := qualitySummary(prog.stream.quality); q != "" {
+		hts = append(hts, headerText{termbox.ColorRed, "Recorded " + q})
+	}
+	drawHeader(paneWav, wavHeaderY, hts...)
 
-	switch {
-	case basicErrStatus != "":
-		drawHeader(basicHeaderY, headerText{termbox.ColorRed, basicErrStatus})
+	hts = nil
+	if hexRangeStatus != "" {
+		hts = append(hts, headerText{fgCol, hexRangeStatus})
+	}
+	if hexWarnStatus != "" {
+		hts = append(hts, headerText{termbox.ColorYellow, hexWarnStatus})
+	}
+	if hexErrStatus != "" {
+		hts = append(hts, headerText{termbox.ColorRed, hexErrStatus})
+	}
+	if hexNoteStatus != "" {
+		hts = append(hts, headerText{termbox.ColorMagenta, hexNoteStatus})
+	}
+	drawHeader(paneHex, hexHeaderY, hts...)
+
+	hts = nil
+	if basicLeft > 0 {
+		hts = append(hts, headerText{fgCol, fmt.Sprintf("Scrolled right %d", basicLeft)})
+	}
+	if basicErrStatus != "" {
+		hts = append(hts, headerText{termbox.ColorRed, basicErrStatus})
+	}
+	if basicWarnStatus != "" {
+		hts = append(hts, headerText{termbox.ColorYellow, basicWarnStatus})
+	}
+	if len(prog.lines) == 0 && prog.header != nil && !prog.header.basic {
+		text := blockDescription(prog)
+		if blockKindOf(*prog.header) != blockOther {
+			text = text + ", " + keysFor("preview-image") + " to preview"
+		}
+		hts = append(hts, headerText{fgCol, text})
+	}
+	if basicCodeStatus != "" {
+		hts = append(hts, headerText{termbox.ColorMagenta, basicCodeStatus})
+	}
+	if basicNoteStatus != "" {
+		hts = append(hts, headerText{termbox.ColorMagenta, basicNoteStatus})
+	}
+	drawHeader(paneBasic, basicHeaderY, hts...)
+}
+
+var statusMessage string
+
+var promptActive bool
+var promptLabel, promptText string
+var promptDone func(string)
+
+// startPrompt asks for a line of text in the status bar, calling done with
+// it once Enter is pressed.
+func startPrompt(label, text string, done func(string)) {
+	promptActive = true
+	promptLabel, promptText, promptDone = label, text, done
+	redrawStatus()
+	termbox.Flush()
+}
+
+func handlePromptKey(ev termbox.Event) {
+	switch ev.Key {
+	case termbox.KeyEsc:
+		promptActive = false
+	case termbox.KeyEnter:
+		promptActive = false
+		promptDone(promptText)
+	case termbox.KeyBackspace, termbox.KeyBackspace2:
+		if r := []rune(promptText); len(r) > 0 {
+			promptText = string(r[:len(r)-1])
+		}
+	case termbox.KeySpace:
+		promptText = promptText + " "
 	default:
-		drawHeader(basicHeaderY)
+		if ev.Ch != 0 {
+			promptText = promptText + string(ev.Ch)
+		}
 	}
+	redrawStatus()
+	termbox.Flush()
+}
+
+// setStatusMessage shows a message in the status bar until the next key.
+func setStatusMessage(msg string) {
+	statusMessage = msg
+	redrawStatus()
+	termbox.Flush()
 }
 
 func redrawStatus() {
-	status := " Instructions go here....  Press Esc to quit"
+	status := fmt.Sprintf(" Press %s for help, %s to quit", keysFor("help"), keysFor("quit"))
+	switch {
+	case promptActive:
+		status = fmt.Sprintf(" %s: %s_", promptLabel, promptText)
+	case searchActive:
+		status = fmt.Sprintf(" Search: %s_  (%d matches)", searchQuery, len(searchResults))
+	case statusMessage != "":
+		status = " " + statusMessage
+	case sweeping != nil:
+		status = " " + sweepStatus()
+	}
+	problems := problemStatus() + " "
 	x := 0
 	for _, c := range status {
 		termbox.SetCell(x, statusY, c, termbox.ColorWhite, termbox.ColorBlue)
@@ -274,6 +704,9 @@ func redrawStatus() {
 	for ; x < currentWidth; x++ {
 		termbox.SetCell(x, statusY, ' ', termbox.ColorWhite, termbox.ColorBlue)
 	}
+	if len(status)+len(problems) < currentWidth {
+		tbPrint(currentWidth-len([]rune(problems)), statusY, termbox.ColorWhite, termbox.ColorBlue, problems)
+	}
 }
 
 func redrawAll() {
@@ -283,12 +716,18 @@ func redrawAll() {
 		resetSize(w, h)
 	}
 
+	redrawMap()
 	redrawWav()
 	redrawHex()
 	redrawBasic()
 	redrawSelection(true)
 	redrawHeaders()
+	redrawNotes()
 	redrawStatus()
+	redrawHistogram()
+	redrawStreamList()
+	redrawSuggestions()
+	redrawPreview()
 
 	termbox.Flush()
 
@@ -300,36 +739,53 @@ func redrawAll() {
 }
 
 var hexSelStart, hexSelEnd int = 0, 20
+var hexRangeStart, hexRangeEnd int = -1, -1
 var hexCursor = 0
 var basicCursorLine int = -1
 var basicCursorL, basicCursorR = 0, 10
 
-func redrawSelection(visible bool) {
+// shadeHex sets the background of the visible part of a range of bytes in
+// the hex pane.
+func shadeHex(start, end int, bg termbox.Attribute) {
+	if hexEnd < start || hexStart > end {
+		return
+	}
 	cells := termbox.CellBuffer()
-	bg := bgCol
-	if hexEnd >= hexSelStart && hexStart <= hexSelEnd {
-		if visible {
-			bg = selCol
-		}
-		// Calc the hex number start and end offsets.
-		sh := max(hexSelStart, hexStart) - hexStart
-		eh := min(hexSelEnd, hexEnd) - hexStart
 
-		// Calc the start row and column.
-		sr := sh / hexCols
-		sc := (sh % hexCols)
+	// Calc the hex number start and end offsets.
+	sh := max(start, hexStart) - hexStart
+	eh := min(end, hexEnd) - hexStart
 
-		// Calc the end row and column.
-		er := eh / hexCols
-		ec := sc + (eh - sh + 1) - (er-sr)*hexCols
+	// Calc the start row and column.
+	sr := sh / hexCols
+	sc := (sh % hexCols)
 
-		// Calc the start and end cell indexes.
-		si := sc*3 + (hexY+sr)*currentWidth
-		ei := min(ec*3, currentWidth-1) + (hexY+er)*currentWidth
+	// Calc the end row and column.
+	er := eh / hexCols
+	ec := sc + (eh - sh + 1) - (er-sr)*hexCols
 
-		for i := si; i <= ei; i++ {
-			cells[i].Bg = bg
+	// Calc the start and end cell indexes.
+	si := sc*3 + (hexY+sr)*currentWidth
+	ei := min(ec*3, paneWidth-1) + (hexY+er)*currentWidth
+
+	for i := si; i <= ei; i++ {
+		cells[i].Bg = bg
+	}
+}
+
+func redrawSelection(visible bool) {
+	cells := termbox.CellBuffer()
+	bg := bgCol
+	if visible {
+		bg = selCol
+	}
+	shadeHex(hexSelStart, hexSelEnd, bg)
+
+	if hexRangeStart >= 0 {
+		if visible {
+			bg = termbox.ColorMagenta
 		}
+		shadeHex(hexRangeStart, hexRangeEnd, bg)
 	}
 
 	if hexEnd >= hexCursor && hexStart <= hexCursor {
@@ -351,7 +807,7 @@ func redrawSelection(visible bool) {
 			bg = selCol
 		}
 		si := ((basicCursorLine - basicStart) + basicY) * currentWidth
-		ei := si + currentWidth
+		ei := si + paneWidth
 		for i := si; i < ei; i++ {
 			cells[i].Bg = bg
 		}
@@ -360,7 +816,14 @@ func redrawSelection(visible bool) {
 			if visible {
 				bg = curCol
 			}
-			for i := si + basicCursorL; i <= si+basicCursorR; i++ {
+			// Column 0 is the margin that stands for the line link bytes, so it
+			// doesn't scroll with the text.
+			l, r := 0, 0
+			if basicCursorL > 0 {
+				l = max(1, basicCursorL-basicLeft)
+				r = min(paneWidth-1, basicCursorR-basicLeft)
+			}
+			for i := si + l; i <= si+r; i++ {
 				cells[i].Bg = bg
 			}
 		}
@@ -371,17 +834,38 @@ func moveHexCursor(newHexCur int) {
 	if newHexCur >= 0 && newHexCur < len(prog.bytes) {
 		redrawSelection(false)
 		hexCursor = newHexCur
+		wavPan = 0
+		if b := prog.bytes[hexCursor]; wavBit < b.firstBit || wavBit > b.lastBit {
+			wavBit = startBit(b)
+		}
 
-		if prog.bytes[hexCursor].chkErr {
+		switch {
+		case prog.bytes[hexCursor].missing:
+			hexErrStatus = "Byte lost in a dropout"
+		case prog.bytes[hexCursor].chkErr:
 			hexErrStatus = "Byte checksum error"
-		} else {
+		default:
 			hexErrStatus = ""
 		}
 		if prog.bytes[hexCursor].unclear {
 			hexWarnStatus = "Byte unclear"
+			if c, ok := byteConfidence(prog, hexCursor); ok {
+				hexWarnStatus = fmt.Sprintf("%s (weakest bit %.0f%% match)", hexWarnStatus, c*100)
+			}
 		} else {
 			hexWarnStatus = ""
 		}
+		if bti := prog.bytes[hexCursor]; hasAudio(prog) {
+			for _, bi := range prog.stream.bits[bti.firstBit : bti.lastBit+1] {
+				if bi.clipped && hexWarnStatus == "" {
+					hexWarnStatus = "Byte clipped"
+					break
+				} else if bi.clipped {
+					hexWarnStatus = hexWarnStatus + ", clipped"
+					break
+				}
+			}
+		}
 
 		// Scroll so that hex cursor is visible.
 		if hexCursor > hexStart+(hexHeight-2)*hexCols {
@@ -410,7 +894,10 @@ func moveHexCursor(newHexCur int) {
 			moveBasicCursor(basicCursorLine)
 		}
 
+		updateNoteStatus()
+		redrawMap()
 		redrawWav()
+		redrawNotes()
 		redrawSelection(true)
 		redrawHeaders()
 		redrawStatus()
@@ -420,6 +907,10 @@ func moveHexCursor(newHexCur int) {
 
 func moveBasicCursor(newBasicCursLine int) {
 	var line lineInfo
+	if len(prog.lines) == 0 {
+		// Not a basic program, so the hex selection covers all the bytes.
+		return
+	}
 	if newBasicCursLine >= -1 && newBasicCursLine <= len(prog.lines) {
 		if basicCursorLine != newBasicCursLine {
 			// Move basic cursor to correct line and update hex selection.
@@ -453,12 +944,17 @@ func moveBasicCursor(newBasicCursLine int) {
 			} else {
 				basicErrStatus = ""
 			}
+			basicWarnStatus = strings.Join(line.suspect, "; ")
 
 		}
 
 		// Move basic cursor to correct element based hex cursor location.
+		basicCodeStatus = ""
 		if basicCursorLine >= 0 && basicCursorLine < len(prog.lines) {
 			hc := hexCursor - hexSelStart
+			if hc > 3 {
+				basicCodeStatus = oricCodeText(prog.bytes, hexCursor)
+			}
 			l := prog.lines[basicCursorLine]
 			switch {
 			case hc == 0, hc == 1:
@@ -466,23 +962,369 @@ func moveBasicCursor(newBasicCursLine int) {
 				basicCursorR = 0
 			case hc == 2, hc == 3:
 				basicCursorL = 1
-				basicCursorR = len(l.elements[0]) - 1
+				basicCursorR = textWidth(l.elements[0]) - 1
 			case hc-3 < len(l.elements):
 				basicCursorL = 1
 				i := 0
 				for ; i < hc-3; i++ {
-					basicCursorL = basicCursorL + len(l.elements[i])
+					basicCursorL = basicCursorL + textWidth(l.elements[i])
 				}
-				basicCursorR = basicCursorL + len(l.elements[i]) - 1
+				basicCursorR = basicCursorL + textWidth(l.elements[i]) - 1
 			default:
-				basicCursorL = len(l.v) + 1
+				basicCursorL = textWidth(l.v) + 1
 				basicCursorR = basicCursorL
 			}
 		}
+
+		// Scroll sideways so the basic cursor is visible.
+		newLeft := basicLeft
+		if basicCursorR-newLeft > paneWidth-2 {
+			newLeft = basicCursorR - (paneWidth - 2)
+		}
+		if basicCursorL > 0 && basicCursorL-newLeft < 1 {
+			newLeft = basicCursorL - 1
+		}
+		if basicCursorL == 0 || basicCursorR < paneWidth-1 {
+			newLeft = 0
+		}
+		if newLeft != basicLeft {
+			basicLeft = newLeft
+			redrawBasic()
+		}
 	}
 }
 
-func displayUI(p program) {
+// hexByteAt returns the index of the byte drawn at the given screen position
+// in the hex pane, or -1 if there isn't one.
+func hexByteAt(x, y int) int {
+	col := (x - 1) / 3
+	if x < 1 || col >= hexCols || y < hexY || y >= hexY+hexHeight {
+		return -1
+	}
+	i := hexStart + (y-hexY)*hexCols + col
+	if i >= len(prog.bytes) {
+		return -1
+	}
+	return i
+}
+
+// basicByteAt returns the index of the byte that produced the element at
+// text column c of the given basic line, where -1 is the margin.
+func basicByteAt(line lineInfo, c int) int {
+	if c < 0 {
+		return line.firstByte
+	}
+	for i, e := range line.elements {
+		if c < textWidth(e) {
+			if i == 0 {
+				return line.firstByte + 2
+			}
+			return min(line.firstByte+3+i, line.lastByte)
+		}
+		c = c - textWidth(e)
+	}
+	return line.lastByte
+}
+
+// wavBitAt returns the index of the bit drawn at column x of the wav pane.
+func wavBitAt(x int) int {
+	bits := prog.stream.bits
+	first, last := wavRange()
+	j := first + max(0, x-1)*(last-first+1)/(currentWidth-2)
+	return min(len(bits)-1, sort.Search(len(bits), func(i int) bool { return bits[i].lastSample >= j }))
+}
+
+// byteOfBit returns the index of the byte containing a bit, or the byte after
+// it if it is between bytes.
+func byteOfBit(bi int) int {
+	return min(len(prog.bytes)-1,
+		sort.Search(len(prog.bytes), func(i int) bool { return prog.bytes[i].lastBit >= bi }))
+}
+
+// moveWavBit moves the wave cursor to a bit, and the hex cursor to its byte.
+func moveWavBit(bi int) {
+	bits := prog.stream.bits
+	bi = max(0, min(len(bits)-1, bi))
+	moveHexCursor(byteOfBit(bi))
+	wavBit = bi
+	refreshWav()
+}
+
+func scrollHex(rows int) {
+	newStart := max(0, min((len(prog.bytes)/hexCols-hexHeight+1)*hexCols, hexStart+rows*hexCols))
+	if newStart != hexStart {
+		redrawSelection(false)
+		hexStart = newStart
+		redrawHex()
+		redrawSelection(true)
+		termbox.Flush()
+	}
+}
+
+func scrollBasic(rows int) {
+	newStart := max(0, min(len(prog.lines)-basicHeight, basicStart+rows))
+	if newStart != basicStart {
+		redrawSelection(false)
+		basicStart = newStart
+		redrawBasic()
+		redrawSelection(true)
+		termbox.Flush()
+	}
+}
+
+func scrollBasicLeft(cols int) {
+	width := 0
+	for _, l := range prog.lines {
+		width = max(width, textWidth(l.v))
+	}
+	newLeft := max(0, min(width-(paneWidth-1)+1, basicLeft+cols))
+	if newLeft != basicLeft {
+		redrawSelection(false)
+		basicLeft = newLeft
+		redrawBasic()
+		redrawSelection(true)
+		redrawHeaders()
+		termbox.Flush()
+	}
+}
+
+// moveBasicLine moves the hex cursor to the first byte of the given basic
+// line, where -1 and len(prog.lines) are the bytes before and after the
+// program lines.
+func moveBasicLine(newLine int) {
+	if len(prog.lines) == 0 {
+		return
+	}
+	last := len(prog.lines)
+	if prog.lines[last-1].lastByte+1 >= len(prog.bytes) {
+		last--
+	}
+	newLine = max(-1, min(last, newLine))
+
+	newHexCur := 0
+	switch {
+	case newLine >= len(prog.lines):
+		newHexCur = prog.lines[len(prog.lines)-1].lastByte + 1
+	case newLine >= 0:
+		newHexCur = prog.lines[newLine].firstByte
+	}
+	redrawSelection(false)
+	moveBasicCursor(newLine)
+	moveHexCursor(newHexCur)
+}
+
+func setHexRange(start, end int) {
+	redrawSelection(false)
+	hexRangeStart, hexRangeEnd = start, end
+	if start >= 0 {
+		hexRangeStatus = fmt.Sprintf("Bytes %d-%d selected (%d bytes)", start, end, end-start+1)
+	} else {
+		hexRangeStatus = ""
+	}
+	redrawSelection(true)
+	redrawHeaders()
+	termbox.Flush()
+}
+
+var dragAnchor = -1
+
+func handleMouse(ev termbox.Event) {
+	x, y := ev.MouseX, ev.MouseY
+	switch ev.Key {
+	case termbox.MouseLeft:
+		switch {
+		case y == mapY || y == mapMarkY:
+			if ev.Mod&termbox.ModMotion == 0 {
+				jumpToSample(x * tapeLength / currentWidth)
+			}
+		case ev.Mod&termbox.ModMotion != 0:
+			// Drag out a range of bytes in the hex pane.
+			if i := hexByteAt(x, y); i >= 0 && dragAnchor >= 0 {
+				setHexRange(min(dragAnchor, i), max(dragAnchor, i))
+				moveHexCursor(i)
+			}
+		case y >= wavY && y <= wavRoleY && hasAudio(prog):
+			moveWavBit(wavBitAt(x))
+		case notesVisible && x >= paneWidth && y > hexHeaderY && y < statusY:
+			focus = paneNotes
+			selectNote(notesTop + y - hexHeaderY - 1)
+			redrawHeaders()
+			redrawNotes()
+			termbox.Flush()
+		case y >= hexY && y < hexY+hexHeight:
+			if i := hexByteAt(x, y); i >= 0 {
+				dragAnchor = i
+				setHexRange(-1, -1)
+				moveHexCursor(i)
+			}
+		case y >= basicY && y < basicY+basicHeight:
+			if l := basicStart + y - basicY; l < len(prog.lines) {
+				redrawSelection(false)
+				moveBasicCursor(l)
+				c := x - 1 + basicLeft
+				if x < 1 {
+					c = -1
+				}
+				moveHexCursor(basicByteAt(prog.lines[l], c))
+			}
+		}
+	case termbox.MouseRelease:
+		if dragAnchor >= 0 && hexRangeStart == hexRangeEnd {
+			setHexRange(-1, -1)
+		}
+		dragAnchor = -1
+	case termbox.MouseWheelUp, termbox.MouseWheelDown:
+		delta := 1
+		if ev.Key == termbox.MouseWheelUp {
+			delta = -1
+		}
+		switch {
+		case y >= wavHeaderY && y <= wavRoleY:
+			panWav(delta)
+		case notesVisible && x >= paneWidth:
+			notesTop = max(0, notesTop+delta)
+			redrawNotes()
+			termbox.Flush()
+		case y >= hexHeaderY && y < hexY+hexHeight:
+			scrollHex(delta)
+		case y >= basicHeaderY && y < basicY+basicHeight:
+			scrollBasic(delta)
+		}
+	}
+}
+
+type motion int
+
+const (
+	motionLeft motion = iota
+	motionRight
+	motionUp
+	motionDown
+	motionPageUp
+	motionPageDown
+	motionHome
+	motionEnd
+)
+
+// moveInPane applies a cursor motion to whichever pane has the focus.
+func moveInPane(m motion) {
+	switch focus {
+	case paneWav:
+		moveWav(m)
+	case paneHex:
+		moveHex(m)
+	case paneBasic:
+		moveBasic(m)
+	case paneNotes:
+		moveNotes(m)
+	}
+}
+
+func moveWav(m motion) {
+	switch {
+	case m == motionLeft && wavZoom == zoomCycle:
+		moveWavBit(wavBit - 1)
+		return
+	case m == motionRight && wavZoom == zoomCycle:
+		moveWavBit(wavBit + 1)
+		return
+	}
+	switch m {
+	case motionLeft:
+		panWav(-1)
+	case motionRight:
+		panWav(1)
+	case motionUp:
+		zoomWav(-1)
+	case motionDown:
+		zoomWav(1)
+	case motionPageUp:
+		panWav(-4)
+	case motionPageDown:
+		panWav(4)
+	case motionHome, motionEnd:
+		wavPan = 0
+		refreshWav()
+	}
+}
+
+func moveHex(m motion) {
+	page := hexCols * (hexHeight - 1)
+	switch m {
+	case motionLeft:
+		moveHexCursor(hexCursor - 1)
+	case motionRight:
+		moveHexCursor(hexCursor + 1)
+	case motionUp:
+		moveHexCursor(hexCursor - hexCols)
+	case motionDown:
+		moveHexCursor(hexCursor + hexCols)
+	case motionPageUp:
+		moveHexCursor(max(0, hexCursor-page))
+	case motionPageDown:
+		moveHexCursor(min(len(prog.bytes)-1, hexCursor+page))
+	case motionHome:
+		moveHexCursor(0)
+	case motionEnd:
+		moveHexCursor(len(prog.bytes) - 1)
+	}
+}
+
+func moveBasic(m motion) {
+	switch m {
+	case motionLeft:
+		scrollBasicLeft(-(paneWidth - 1) / 4)
+	case motionRight:
+		scrollBasicLeft((paneWidth - 1) / 4)
+	case motionUp:
+		moveBasicLine(basicCursorLine - 1)
+	case motionDown:
+		moveBasicLine(basicCursorLine + 1)
+	case motionPageUp:
+		moveBasicLine(basicCursorLine - (basicHeight - 1))
+	case motionPageDown:
+		moveBasicLine(basicCursorLine + (basicHeight - 1))
+	case motionHome:
+		moveBasicLine(0)
+	case motionEnd:
+		moveBasicLine(len(prog.lines) - 1)
+	}
+}
+
+func previousProgram() {
+	if progIndex > 0 {
+		loadProgram(progIndex - 1)
+	}
+}
+
+func nextProgram() {
+	if progIndex < len(programs)-1 {
+		loadProgram(progIndex + 1)
+	}
+}
+
+// loadProgram switches the UI over to showing the given program.
+func loadProgram(i int) {
+	progIndex = i
+	prog = programs[i]
+	hexCursor, hexStart, basicStart, basicLeft, wavPan = 0, 0, 0, 0, 0
+	wavBit = startBit(prog.bytes[0])
+	hexRangeStart, hexRangeEnd, hexRangeStatus = -1, -1, ""
+	basicCursorLine = -1
+	basicErrStatus, basicWarnStatus, basicCodeStatus = "", "", ""
+	notesSel, notesTop = 0, 0
+	hexSelStart = 0
+	if len(prog.lines) > 0 {
+		hexSelEnd = prog.lines[0].firstByte - 1
+	} else {
+		hexSelEnd = len(prog.bytes) - 1
+	}
+	termbox.Clear(fgCol, bgCol)
+	redrawAll()
+	moveHexCursor(0)
+}
+
+func displayUI(s []bitStream, ps []program) {
 	err := termbox.Init()
 	if err != nil {
 		fmt.Printf("%s**** %s ****%s", CLR_R, err, CLR_0)
@@ -491,11 +1333,11 @@ func displayUI(p program) {
 	defer termbox.Close()
 	termbox.SetInputMode(termbox.InputEsc | termbox.InputMouse)
 
-	prog = p
-	hexSelStart = 0
-	hexSelEnd = prog.lines[0].firstByte - 1
-
-	redrawAll()
+	streams = s
+	programs = ps
+	signalMap, _, _ = findSignal(tapeSamples)
+	loadProgram(0)
+	restoreView()
 
 mainloop:
 	for {
@@ -503,25 +1345,75 @@ mainloop:
 		case termbox.EventKey:
 			//			tbPrint(0, currentHeight - 1, fgCol, bgCol,
 			//				fmt.Sprintf("EventKey: k: %d, c: %c, mod: %d", ev.Key, ev.Ch, ev.Mod))
-			switch ev.Key {
-			case termbox.KeyEsc:
+			if statusMessage != "" {
+				statusMessage = ""
+				redrawStatus()
+				termbox.Flush()
+			}
+			if searchActive {
+				handleSearchKey(ev)
+				continue
+			}
+			if promptActive {
+				handlePromptKey(ev)
+				continue
+			}
+			if helpVisible {
+				handleHelpKey(ev)
+				continue
+			}
+			if histVisible {
+				handleHistogramKey(ev)
+				continue
+			}
+			if streamListVisible {
+				handleStreamListKey(ev)
+				continue
+			}
+			if suggestVisible {
+				handleSuggestKey(ev)
+				continue
+			}
+			if previewVisible {
+				handlePreviewKey(ev)
+				continue
+			}
+			switch a := bindings[keySpec{ev.Key, ev.Ch}]; a {
+			case "":
+			case "quit":
 				break mainloop
-			case termbox.KeyArrowLeft, termbox.KeyCtrlB:
-				moveHexCursor(hexCursor - 1)
-			case termbox.KeyArrowRight, termbox.KeyCtrlF:
-				moveHexCursor(hexCursor + 1)
-			case termbox.KeyArrowUp:
-				moveHexCursor(hexCursor - hexCols)
-			case termbox.KeyArrowDown:
-				moveHexCursor(hexCursor + hexCols)
+			case "help":
+				showHelp()
+			default:
+				actions[a].run()
 			}
 		case termbox.EventMouse:
-			tbPrint(0, currentHeight-1, fgCol, bgCol,
-				fmt.Sprintf("EventMouse: x: %d, y: %d, b: %d", ev.MouseX, ev.MouseY, mouse_button_num(ev.Key)))
+			if helpVisible {
+				handleHelpMouse(ev)
+				continue
+			}
+			if previewVisible {
+				continue
+			}
+			if histVisible {
+				handleHistogramMouse(ev)
+				continue
+			}
+			if streamListVisible {
+				handleStreamListMouse(ev)
+				continue
+			}
+			handleMouse(ev)
+		case termbox.EventInterrupt:
+			checkSweep()
 		case termbox.EventNone:
 			tbPrint(0, currentHeight-1, fgCol, bgCol, "EventNone")
 		case termbox.EventResize:
 			redrawAll()
+			if helpVisible {
+				redrawHelp()
+				termbox.Flush()
+			}
 		case termbox.EventError:
 			panic(ev.Err)
 		}
@@ -0,0 +1,239 @@
+// Copyright © 2015 The Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the LICENSE file for the specific language governing permissions and
+// limitations under the License in the main package.
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+var framingNames = []string{"simple", "viterbi"}
+
+// How unlikely a clear bit is to be wrong, and how unlikely a byte is to
+// have bad parity, as negative log probabilities. A clear bit costs more to
+// flip than bad parity, so only doubtful bits are changed to fix parity.
+const clearBitCost = 6.9
+const parityCost = 4.6
+
+// bitCost returns how unlikely (as a negative log probability) it is that a
+// cycle is the given bit. Doubtful cycles are judged by the demodulator's
+// confidence if it has one, or else by where their length falls between the
+// thresholds.
+func bitCost(bi bitInfo, v bit, settings decoderSettings) float64 {
+	if !bi.unclear {
+		if v == bi.v {
+			return -math.Log1p(-math.Exp(-clearBitCost))
+		}
+		return clearBitCost
+	}
+	var p1 float64
+	if bi.confidence > 0 {
+		p1 = 0.5 + bi.confidence/2
+		if bi.v == 0 {
+			p1 = 1 - p1
+		}
+	} else {
+		mid := float64(settings.ShortThreshold+settings.LongThreshold) / 2
+		scale := math.Max(1, float64(settings.LongThreshold-settings.ShortThreshold)/4)
+		p1 = 1 / (1 + math.Exp((float64(bi.l1+bi.l2)-mid)/scale))
+	}
+	p1 = math.Max(1e-3, math.Min(1-1e-3, p1))
+	if v == 1 {
+		return -math.Log(p1)
+	}
+	return -math.Log(1 - p1)
+}
+
+// The states of the byte frame a bit can leave the decoder in. After the
+// parity bit there must be at least one stop bit (a 1), then any number more
+// before the start bit (a 0), then 8 data bits, whose parity so far is part
+// of the state, then the parity bit.
+const (
+	frameNeedStop = iota
+	frameStop
+	frameStart
+	frameData      // frameData + 2*i + parity, after data bit i
+	numFrameStates = frameData + 16
+)
+
+// readProgramBytesViterbi frames the bits of a stream into bytes like
+// readProgramBytes, but rather than deciding each bit for good it finds the
+// most likely way through the whole stream, scored by how well each cycle
+// fits its bit and whether each byte's parity holds. So one bad cycle can be
+// read as whichever bit fixes the parity, and can't throw the bytes after it
+// out of frame.
+func readProgramBytesViterbi(stream bitStream, settings decoderSettings) (prog program) {
+	prog.stream = stream
+	bits := stream.bits
+
+	// Find sync just as readProgramBytes does.
+	var by byte
+	first := 0
+	for by != 0x16 {
+		if first >= len(bits) {
+			return
+		}
+		by = by>>1 | byte(bits[first].v<<7)
+		first++
+	}
+	n := len(bits) - first
+	if n <= 0 {
+		return
+	}
+
+	inf := math.Inf(1)
+	cost := make([]float64, numFrameStates)
+	next := make([]float64, numFrameStates)
+	// For each bit and the state it leads to, the best state before it and
+	// the value it was read as.
+	type choice struct {
+		from int8
+		v    bit
+	}
+	choices := make([][numFrameStates]choice, n)
+	for s := range cost {
+		cost[s] = inf
+	}
+	cost[frameNeedStop] = 0
+
+	for i := 0; i < n; i++ {
+		bi := bits[first+i]
+		c := [2]float64{bitCost(bi, 0, settings), bitCost(bi, 1, settings)}
+		for s := range next {
+			next[s] = inf
+		}
+		if bi.dropout {
+			// Nothing is known of the frame after a dropout, so it may
+			// pick up anywhere.
+			from := 0
+			for s := range cost {
+				if cost[s] < cost[from] {
+					from = s
+				}
+			}
+			for s := range next {
+				next[s] = cost[from]
+				choices[i][s] = choice{int8(from), 1}
+			}
+			cost, next = next, cost
+			continue
+		}
+		step := func(fromState, toState int, v bit, extra float64) {
+			if total := cost[fromState] + c[v] + extra; total < next[toState] {
+				next[toState] = total
+				choices[i][toState] = choice{int8(fromState), v}
+			}
+		}
+		step(frameNeedStop, frameStop, 1, 0)
+		if i == 0 {
+			// The first bit is the sync byte's parity, so it may be
+			// either, as readProgramBytes skips it.
+			step(frameNeedStop, frameStop, 0, 0)
+		}
+		step(frameStop, frameStop, 1, 0)
+		step(frameStop, frameStart, 0, 0)
+		step(frameStart, frameData, 0, 0)
+		step(frameStart, frameData+1, 1, 0)
+		for d := 0; d < 7; d++ {
+			for p := 0; p < 2; p++ {
+				s := frameData + 2*d + p
+				step(s, frameData+2*(d+1)+p, 0, 0)
+				step(s, frameData+2*(d+1)+(p^1), 1, 0)
+			}
+		}
+		// Odd parity: the parity bit and the data bits have an odd number
+		// of 1s between them.
+		for p := 0; p < 2; p++ {
+			s := frameData + 14 + p
+			for v := bit(0); v <= 1; v++ {
+				extra := 0.0
+				if (p+int(v))%2 == 0 {
+					extra = parityCost
+				}
+				step(s, frameNeedStop, v, extra)
+			}
+		}
+		cost, next = next, cost
+	}
+
+	// Trace back from the best state to find the role of every bit.
+	best := 0
+	for s := range cost {
+		if cost[s] < cost[best] {
+			best = s
+		}
+	}
+	states := make([]int, n)
+	values := make([]bit, n)
+	for i, s := n-1, best; i >= 0; i-- {
+		states[i], values[i] = s, choices[i][s].v
+		s = int(choices[i][s].from)
+	}
+
+	byteStart := -1
+	var v, chk byte
+	var unclear bool
+	for i, s := range states {
+		bi := bits[first+i]
+		switch {
+		case i == 0 || states[i-1] == frameNeedStop:
+			byteStart, v, chk, unclear = first+i, 0, 0, false
+		case s >= frameData:
+			v = v>>1 | byte(values[i]<<7)
+			chk = chk + byte(values[i])
+		}
+		unclear = unclear || bi.unclear || values[i] != bi.v
+		if s == frameNeedStop && byteStart >= 0 {
+			prog.bytes = append(prog.bytes, byteInfo{v: v, firstBit: byteStart, lastBit: first + i,
+				unclear: unclear, chkErr: values[i] == bit(chk&1)})
+			byteStart = -1
+		}
+	}
+	return
+}
+
+// readStreamBytes frames a stream into bytes with the framing chosen in the
+// settings.
+func readStreamBytes(stream bitStream, settings decoderSettings) (prog program) {
+	if settings.Framing == "viterbi" {
+		prog = readProgramBytesViterbi(stream, settings)
+	} else {
+		prog = readProgramBytes(stream)
+	}
+	fillDropouts(&prog)
+	return
+}
+
+// toggleFraming switches between simple and Viterbi framing and decodes the
+// tape again.
+func toggleFraming() {
+	if !needAudio("frame the bytes of") {
+		return
+	}
+	if proj.Settings.Framing == "viterbi" {
+		proj.Settings.Framing = ""
+	} else {
+		proj.Settings.Framing = "viterbi"
+	}
+	redecode()
+	setStatusMessage(fmt.Sprintf("Framing bytes with the %s decoder", framingName(proj.Settings)))
+}
+
+func framingName(settings decoderSettings) string {
+	if settings.Framing == "" {
+		return "simple"
+	}
+	return settings.Framing
+}
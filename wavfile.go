@@ -18,6 +18,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -37,7 +38,7 @@ type riff struct {
 	Length         uint32
 }
 
-func readWavFile(fileName string) (left, right []int16, err error) {
+func readWavFile(fileName string, log io.Writer) (left, right []int16, err error) {
 	var r riff
 
 	file, err := os.Open(fileName)
@@ -79,7 +80,7 @@ func readWavFile(fileName string) (left, right []int16, err error) {
 		right[i] = int16(binary.LittleEndian.Uint16(bytes[bi+2 : bi+4]))
 	}
 
-	fmt.Printf("Found %d seconds of audio (%d samples)\n", samplesToRead/44100, samplesToRead)
+	fmt.Fprintf(log, "Found %d seconds of audio (%d samples)\n", samplesToRead/44100, samplesToRead)
 
 	return left, right, err
 }